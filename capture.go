@@ -0,0 +1,107 @@
+package tesuto
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// CapturedRequest is a request as received by the server. See CaptureRequest.
+type CapturedRequest struct {
+	Method string
+	URL    *url.URL
+	Host   string
+	Header http.Header
+	Body   []byte
+}
+
+// NewCapturing starts a server for handler and creates a new test suite for it,
+// like New(httptest.NewServer(handler)), but the server records requests so that CaptureRequest can be used.
+// Close the server when finished.
+func NewCapturing(handler http.Handler) HTTP {
+	c := &capturer{requests: make(map[string]CapturedRequest)}
+	suite := New(httptest.NewServer(c.wrap(handler)))
+	suite.capture = c
+	return suite
+}
+
+// CaptureRequest takes a pointer to a CapturedRequest and sets it to the request as the server received it,
+// for checking what the handler saw.
+// The suite must be created with NewCapturing, or the test must be run with TestHandler.
+func CaptureRequest(out *CapturedRequest) TestOption {
+	id := strconv.FormatUint(atomic.AddUint64(&captureID, 1), 10)
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set(captureHeader, id)
+		})
+		tc.checks = append(tc.checks, func(*result) error {
+			if tc.capture == nil {
+				return fmt.Errorf("CaptureRequest requires a suite created with NewCapturing")
+			}
+			captured, ok := tc.capture.take(id)
+			if !ok {
+				return fmt.Errorf("request was not captured")
+			}
+			*out = captured
+			return nil
+		})
+	}
+}
+
+// captureHeader identifies requests to capture.
+const captureHeader = "X-Tesuto-Capture"
+
+var captureID uint64
+
+// capturer records requests marked with captureHeader.
+type capturer struct {
+	mu       sync.Mutex
+	requests map[string]CapturedRequest
+}
+
+// wrap returns a handler that records requests before passing them to next.
+func (c *capturer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(captureHeader)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(captureHeader)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		u := *r.URL
+		c.mu.Lock()
+		c.requests[id] = CapturedRequest{
+			Method: r.Method,
+			URL:    &u,
+			Host:   r.Host,
+			Header: r.Header.Clone(),
+			Body:   body,
+		}
+		c.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take returns and forgets the captured request with the given ID.
+func (c *capturer) take(id string) (CapturedRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req, ok := c.requests[id]
+	delete(c.requests, id)
+	return req, ok
+}
@@ -0,0 +1,199 @@
+package tesuto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Cassette is a set of recorded responses, as written by RecordTo and read by ReplayFrom.
+// It is stored as indented JSON so changes to it are easy to review.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded response, keyed by its request's method, path, and a hash of its body.
+type Interaction struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is the response body if it is valid UTF-8, otherwise it is stored in RawBody.
+	Body    string `json:"body,omitempty"`
+	RawBody []byte `json:"raw_body,omitempty"`
+}
+
+// RecordTo sends the request as usual and records its response to the cassette file at path,
+// creating it if necessary. Responses recorded earlier for the same request are replaced.
+// Combine it with ReplayFrom to make tests that can run without the real server:
+//
+//	var cassette = tesuto.ReplayFrom("testdata/api.json")
+//	if *record {
+//		cassette = tesuto.RecordTo("testdata/api.json")
+//	}
+func RecordTo(path string) TestOption {
+	return func(tc *testCase) {
+		tc.cassette = &cassetteTransport{path: path, record: true}
+	}
+}
+
+// ReplayFrom serves the response for this test from the cassette file at path, written by RecordTo,
+// instead of sending the request to the server. The test fails if there's no response recorded for the request.
+// Requests are matched by method, path and query, and body, so the server's address may change between recording and replaying.
+func ReplayFrom(path string) TestOption {
+	return func(tc *testCase) {
+		tc.cassette = &cassetteTransport{path: path}
+	}
+}
+
+// cassetteTransport is a RoundTripper that records or replays responses.
+type cassetteTransport struct {
+	path   string
+	record bool
+	next   http.RoundTripper
+}
+
+// cassetteMu guards cassette files, so recording tests can run in parallel.
+var cassetteMu sync.Mutex
+
+func (ct *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := cassetteKey(req, body)
+
+	if !ct.record {
+		cassetteMu.Lock()
+		cassette, err := loadCassette(ct.path)
+		cassetteMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, in := range cassette.Interactions {
+			if in.Key == key {
+				return in.response(req), nil
+			}
+		}
+		return nil, fmt.Errorf("no response recorded in cassette %s for request: %s", ct.path, key)
+	}
+
+	// send a copy with a fresh body, as the original has been consumed
+	sreq := req.Clone(req.Context())
+	if req.Body != nil {
+		sreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := ct.next.RoundTrip(sreq)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	resp.Request = req
+
+	in := Interaction{
+		Key:    key,
+		Status: resp.StatusCode,
+		Header: resp.Header,
+	}
+	if utf8.Valid(respBody) {
+		in.Body = string(respBody)
+	} else {
+		in.RawBody = respBody
+	}
+
+	cassetteMu.Lock()
+	defer cassetteMu.Unlock()
+	cassette, err := loadCassette(ct.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	cassette.add(in)
+	if err := cassette.save(ct.path); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// cassetteKey identifies a request by its method, path and query, and a hash of its body.
+func cassetteKey(req *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	return req.Method + " " + req.URL.RequestURI() + " " + hex.EncodeToString(sum[:8])
+}
+
+// loadCassette reads the cassette file at path.
+// If it doesn't exist, an empty cassette is returned along with the error.
+func loadCassette(path string) (*Cassette, error) {
+	cassette := new(Cassette)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cassette, err
+	}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return cassette, fmt.Errorf("invalid cassette %s: %v", path, err)
+	}
+	return cassette, nil
+}
+
+// add adds an interaction, replacing any with the same key.
+// Interactions are kept sorted by key so the file is stable.
+func (c *Cassette) add(in Interaction) {
+	for i := range c.Interactions {
+		if c.Interactions[i].Key == in.Key {
+			c.Interactions[i] = in
+			return
+		}
+	}
+	c.Interactions = append(c.Interactions, in)
+	sort.Slice(c.Interactions, func(i, j int) bool {
+		return c.Interactions[i].Key < c.Interactions[j].Key
+	})
+}
+
+func (c *Cassette) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// response builds the recorded response to req.
+func (in Interaction) response(req *http.Request) *http.Response {
+	body := in.RawBody
+	if body == nil {
+		body = []byte(in.Body)
+	}
+	header := in.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(in.Status) + " " + http.StatusText(in.Status),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
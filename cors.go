@@ -0,0 +1,57 @@
+package tesuto
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// ExpectCORS sends an Origin header with the request and expects the response to allow that origin.
+// Access-Control-Allow-Origin must be either origin or "*".
+// For preflight requests (OPTIONS with Access-Control-Request-Method), Access-Control-Allow-Methods must be present,
+// as must Access-Control-Allow-Headers if Access-Control-Request-Headers was sent.
+func ExpectCORS(origin string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Origin", origin)
+		})
+		tc.checks = append(tc.checks, func(res *result) error {
+			if got := res.resp.Header.Get("Access-Control-Allow-Origin"); got != origin && got != "*" {
+				return fmt.Errorf("unexpected response header (Access-Control-Allow-Origin): want %v, got %v", origin, got)
+			}
+			if res.req.Method != http.MethodOptions || res.req.Header.Get("Access-Control-Request-Method") == "" {
+				return nil
+			}
+			if res.resp.Header.Get("Access-Control-Allow-Methods") == "" {
+				return fmt.Errorf("missing preflight response header (Access-Control-Allow-Methods)")
+			}
+			if res.req.Header.Get("Access-Control-Request-Headers") != "" && res.resp.Header.Get("Access-Control-Allow-Headers") == "" {
+				return fmt.Errorf("missing preflight response header (Access-Control-Allow-Headers)")
+			}
+			return nil
+		})
+	}
+}
+
+// PreflightTest returns a test function that sends a CORS preflight request to path,
+// asking whether origin may use the given method. It expects the method to be allowed, see ExpectCORS.
+// Use WithHeader("Access-Control-Request-Headers", ...) to ask about headers too.
+func (h HTTP) PreflightTest(path, origin, method string, opts ...TestOption) func(*testing.T) {
+	preflight := []TestOption{
+		WithHeader("Access-Control-Request-Method", method),
+		ExpectCORS(origin),
+		func(tc *testCase) {
+			tc.checks = append(tc.checks, func(res *result) error {
+				allowed := res.resp.Header.Get("Access-Control-Allow-Methods")
+				for _, m := range strings.Split(allowed, ",") {
+					if m = strings.TrimSpace(m); m == method || m == "*" {
+						return nil
+					}
+				}
+				return fmt.Errorf("unexpected response header (Access-Control-Allow-Methods): want %v allowed, got %v", method, allowed)
+			})
+		},
+	}
+	return h.Test(http.MethodOptions, path, append(preflight, opts...)...)
+}
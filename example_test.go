@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/guregu/tesuto"
 )
 
@@ -92,3 +93,15 @@ func TestPost(t *testing.T) {
 		tesuto.ExpectStatusCode(http.StatusMethodNotAllowed),
 	))
 }
+
+func ExampleEquateApproxFloat() {
+	type Location struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	}
+	want := Location{Lat: 35.6812, Lng: 139.7671}
+	got := Location{Lat: 35.68123, Lng: 139.76708}
+	// consider values within 0.001 of each other to be equal
+	fmt.Println(cmp.Equal(want, got, tesuto.EquateApproxFloat(0, 0.001)))
+	// Output: true
+}
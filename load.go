@@ -0,0 +1,146 @@
+package tesuto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LoadResult summarizes the responses to the requests sent by Load.
+type LoadResult struct {
+	// Requests is the number of requests sent.
+	Requests int
+	// Errors is the number of requests that failed without a response, or with a body over MaxResponseSize.
+	Errors int
+	// Codes counts the responses by status code.
+	Codes map[int]int
+	// Min, Max, and Avg are the latencies of the responses, including reading their bodies.
+	Min, Max, Avg time.Duration
+	// Elapsed is the time it took to send all of the requests.
+	Elapsed time.Duration
+}
+
+// Load sends total requests, built from the given options, using concurrency workers at once,
+// and returns a summary of the responses. It is a quick sanity check, not a benchmark.
+// Expectations are not checked, so examine the result instead.
+// The test fails if any requests fail without a response, unless AllowLoadErrors is given.
+// The request body must be buffered, see WithInput. RawRequest can't be used.
+// With FailAfter, requests whose responses, including their bodies, don't arrive in time count as errors.
+func (h HTTP) Load(t *testing.T, concurrency, total int, method, path string, opts ...TestOption) LoadResult {
+	t.Helper()
+	tc := h.newTestCase(method, path, opts)
+	if tc.optErr != nil {
+		t.Fatalf("[%s %s] %v", method, path, tc.optErr)
+	}
+	if tc.input != nil && total > 1 {
+		t.Fatalf("[%s %s] Load requires a request body that can be sent again, see WithInput", method, path)
+	}
+	if tc.raw != nil {
+		t.Fatalf("[%s %s] Load can't send a RawRequest", method, path)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	client := tc.client()
+	defer client.CloseIdleConnections()
+
+	type outcome struct {
+		code    int
+		elapsed time.Duration
+		err     error
+	}
+	send := func(req *http.Request) outcome {
+		if tc.failAfter > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), tc.failAfter)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err == nil {
+			if tc.trace != nil {
+				tc.trace.log(req, resp, time.Since(start))
+			}
+			_, err = tc.readBody(resp.Body)
+			resp.Body.Close()
+			if err == errTooLarge {
+				err = tc.tooLarge()
+			}
+		}
+		if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("handler did not respond within %v", tc.failAfter)
+		}
+		if err != nil {
+			return outcome{err: err}
+		}
+		return outcome{code: resp.StatusCode, elapsed: time.Since(start)}
+	}
+	jobs := make(chan struct{})
+	outcomes := make(chan outcome, total)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				req, err := tc.newRequest()
+				if err != nil {
+					outcomes <- outcome{err: err}
+					continue
+				}
+				outcomes <- send(req)
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := 0; i < total; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	close(outcomes)
+
+	result := LoadResult{
+		Requests: total,
+		Codes:    make(map[int]int),
+		Elapsed:  time.Since(start),
+	}
+	var sum time.Duration
+	var firstErr error
+	for o := range outcomes {
+		if o.err != nil {
+			result.Errors++
+			if firstErr == nil {
+				firstErr = o.err
+			}
+			continue
+		}
+		result.Codes[o.code]++
+		sum += o.elapsed
+		if result.Min == 0 || o.elapsed < result.Min {
+			result.Min = o.elapsed
+		}
+		if o.elapsed > result.Max {
+			result.Max = o.elapsed
+		}
+	}
+	if n := total - result.Errors; n > 0 {
+		result.Avg = sum / time.Duration(n)
+	}
+	if result.Errors > 0 && !tc.loadErrors {
+		t.Errorf("[%s %s] %d of %d requests failed, first error: %v", method, path, result.Errors, total, firstErr)
+	}
+	return result
+}
+
+// AllowLoadErrors makes Load count requests that fail without a response in its result instead of failing the test.
+func AllowLoadErrors() TestOption {
+	return func(tc *testCase) {
+		tc.loadErrors = true
+	}
+}
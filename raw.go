@@ -0,0 +1,101 @@
+package tesuto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// RawRequest sends raw as-is over a new connection to the server instead of the request built by the other options,
+// for testing how the server copes with malformed requests such as bad methods or broken headers.
+// The response is parsed as usual, so expectations like ExpectStatusCode work,
+// and GrabRawResponse gets the bytes that were received. The test fails if the response can't be parsed.
+// Options that modify the request have no effect, and it doesn't work with TestHandler, which has no connections.
+func RawRequest(raw []byte) TestOption {
+	return func(tc *testCase) {
+		tc.raw = &rawTransport{request: append([]byte{}, raw...)}
+	}
+}
+
+// GrabRawResponse takes a pointer to a byte slice and sets it to the response as received over the wire.
+// It requires RawRequest.
+func GrabRawResponse(out *[]byte) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(*result) error {
+			if tc.raw == nil {
+				return fmt.Errorf("GrabRawResponse requires RawRequest")
+			}
+			*out = tc.raw.response
+			return nil
+		})
+	}
+}
+
+// rawTransport is a RoundTripper that sends a raw request to the host of the request it is given.
+type rawTransport struct {
+	request   []byte
+	tlsConfig *tls.Config
+	// response is the last response received
+	response []byte
+}
+
+func (rt *rawTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	ctx := req.Context()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if req.URL.Scheme == "https" {
+		cfg := rt.tlsConfig.Clone()
+		if cfg == nil {
+			cfg = new(tls.Config)
+		}
+		// raw requests are HTTP/1
+		cfg.NextProtos = nil
+		if cfg.ServerName == "" {
+			cfg.ServerName = req.URL.Hostname()
+		}
+		conn = tls.Client(conn, cfg)
+	}
+
+	// close the connection if the request is canceled, to interrupt reading
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if _, err := conn.Write(rt.request); err != nil {
+		return nil, err
+	}
+
+	var received bytes.Buffer
+	resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, &received)), req)
+	if err != nil {
+		rt.response = received.Bytes()
+		return nil, fmt.Errorf("couldn't parse raw response: %v\nreceived: %q", err, received.Bytes())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	rt.response = received.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read raw response body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
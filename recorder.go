@@ -0,0 +1,51 @@
+package tesuto
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestHandler runs a test against h without starting a server.
+// Requests are served in-process and recorded with httptest.ResponseRecorder,
+// and all options work the same as they do with a server, including CaptureRequest.
+func TestHandler(t *testing.T, h http.Handler, method, path string, opts ...TestOption) {
+	t.Helper()
+	capture := &capturer{requests: make(map[string]CapturedRequest)}
+	client := &http.Client{
+		Transport: handlerTransport{handler: capture.wrap(h)},
+	}
+	tc := newTestCase("http://example.com", client, method, path, opts)
+	tc.capture = capture
+	tc.fn()(t)
+}
+
+// handlerTransport is a RoundTripper that serves requests with a handler.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (ht handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// turn the client request into what a server would see
+	sreq := req.Clone(req.Context())
+	sreq.URL = &url.URL{
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	sreq.RequestURI = req.URL.RequestURI()
+	if sreq.Host == "" {
+		sreq.Host = req.URL.Host
+	}
+	sreq.RemoteAddr = "192.0.2.1:1234"
+	if sreq.Body == nil {
+		sreq.Body = http.NoBody
+	}
+
+	rec := httptest.NewRecorder()
+	ht.handler.ServeHTTP(rec, sreq)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
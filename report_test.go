@@ -0,0 +1,23 @@
+package tesuto
+
+import "testing"
+
+func TestColorize(t *testing.T) {
+	msg := "- not part of the diff\noutput mismatch (-want +got):\n  map[string]int{\n-\t\"a\": 1,\n+\t\"a\": 2,\n  }"
+	want := "- not part of the diff\noutput mismatch (-want +got):\n  map[string]int{\n" +
+		"\x1b[31m-\t\"a\": 1,\x1b[0m\n\x1b[32m+\t\"a\": 2,\x1b[0m\n  }"
+	if got := colorize(msg); got != want {
+		t.Errorf("bad colors:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	plain := "-1 isn't a diff"
+	if got := colorize(plain); got != plain {
+		t.Errorf("colored a message without a diff: %q", got)
+	}
+
+	rep := &report{method: "GET", path: "/", color: true}
+	rep.fail("output mismatch %s-\"x\"", diffHeader)
+	if want := "output mismatch (-want +got):\n\x1b[31m-\"x\"\x1b[0m"; len(rep.failures) != 1 || rep.failures[0] != want {
+		t.Errorf("report didn't color its failure: %q", rep.failures)
+	}
+}
@@ -1,18 +1,39 @@
 package tesuto
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/google/go-cmp/cmp"
@@ -22,214 +43,2924 @@ import (
 // HTTP is a test suite wrapper around httptest.Server.
 type HTTP struct {
 	*httptest.Server
+
+	verbose     bool
+	capture     *capturer
+	contentType string
+	errorPath   string
+	idemHeader  string
+	// response size limit: 0 is the default, negative is unlimited
+	sizeLimit int64
+	// for suites without a server, see NewURL
+	baseURL string
+	client  *http.Client
+	trace   *tracer
+	jar     *cookiejar.Jar
+}
+
+// New creates a new test suite.
+func New(server *httptest.Server) HTTP {
+	return HTTP{
+		Server: server,
+	}
+}
+
+// NewHTTP2 starts a TLS server for handler with HTTP/2 enabled and creates a new test suite for it.
+// The suite's requests will use HTTP/2. Close the server when finished.
+func NewHTTP2(handler http.Handler) HTTP {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return New(server)
+}
+
+// NewURL creates a new test suite for the server at baseURL, such as "https://staging.example.com",
+// for running the same tests against a deployed server. Requests are sent with http.DefaultClient.
+// All options work as usual, except those that need the server to be in-process, like CaptureRequest.
+// The suite has no Server, so the methods of Server other than Close can't be used.
+func NewURL(baseURL string) HTTP {
+	return HTTP{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  http.DefaultClient,
+	}
+}
+
+// Close closes the suite's server, if it has one.
+func (h HTTP) Close() {
+	if h.Server != nil {
+		h.Server.Close()
+	}
+}
+
+// url returns the base URL of requests.
+func (h HTTP) url() string {
+	if h.Server == nil {
+		return h.baseURL
+	}
+	return h.Server.URL
+}
+
+// httpClient returns the client to base each test's client on.
+func (h HTTP) httpClient() *http.Client {
+	if h.Server == nil {
+		return h.client
+	}
+	return h.Server.Client()
+}
+
+// Test returns a test function suitable for running with t.Run.
+//
+// Request bodies are sent with any method, including GET, HEAD, DELETE, OPTIONS, and custom methods,
+// so APIs such as bulk deletes can be tested with the usual input options.
+// Following a redirect is where a body can be lost: the client turns requests redirected with
+// 301, 302, or 303 into GET requests without a body, as browsers do. This includes the redirects
+// http.ServeMux sends to add a trailing slash, so use the canonical path or NoFollowRedirects.
+// Bodies are sent again for 307 and 308 redirects, but only if they can be rewound,
+// which is the case for every input option except WithInput and WithBody with arbitrary readers; see WithInputFunc.
+func (h HTTP) Test(method string, path string, opts ...TestOption) func(*testing.T) {
+	return h.newTestCase(method, path, opts).fn()
+}
+
+// GET returns a test function for a GET request, like Test.
+func (h HTTP) GET(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodGet, path, opts...)
+}
+
+// POST returns a test function for a POST request, like Test.
+func (h HTTP) POST(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodPost, path, opts...)
+}
+
+// PUT returns a test function for a PUT request, like Test.
+func (h HTTP) PUT(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodPut, path, opts...)
+}
+
+// PATCH returns a test function for a PATCH request, like Test.
+func (h HTTP) PATCH(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodPatch, path, opts...)
+}
+
+// DELETE returns a test function for a DELETE request, like Test.
+func (h HTTP) DELETE(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodDelete, path, opts...)
+}
+
+// HEAD returns a test function for a HEAD request, like Test.
+func (h HTTP) HEAD(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodHead, path, opts...)
+}
+
+// OPTIONS returns a test function for an OPTIONS request, like Test.
+func (h HTTP) OPTIONS(path string, opts ...TestOption) func(*testing.T) {
+	return h.Test(http.MethodOptions, path, opts...)
+}
+
+// Verbose sets whether response bodies are always logged.
+// By default, they are only logged when a test fails.
+func (h *HTTP) Verbose(verbose bool) {
+	h.verbose = verbose
+}
+
+// ResetJar gives the suite a new, empty cookie jar, shared by the tests created after this is called,
+// so cookies from earlier tests such as logins don't leak into them.
+// Tests with their own jar from WithCookieJar or FreshJar don't use the suite's jar.
+func (h *HTTP) ResetJar() {
+	h.jar = newJar()
+}
+
+// Trace writes a one-line summary of every request the suite's tests send to w,
+// with the method, URL, status code, and time taken, like "GET /users 200 1.2ms".
+// This includes the extra requests of Repeat, RetryUntil, and ExpectIdempotent, and those sent by Load, but not Dial.
+// Use nil to stop tracing, which is the default. It is safe for w to be shared by parallel tests.
+func (h *HTTP) Trace(w io.Writer) {
+	if w == nil {
+		h.trace = nil
+		return
+	}
+	h.trace = &tracer{w: w}
+}
+
+// tracer writes request summaries for Trace.
+type tracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (tr *tracer) log(req *http.Request, resp *http.Response, elapsed time.Duration) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	fmt.Fprintf(tr.w, "%s %s %d %v\n", req.Method, req.URL.RequestURI(), resp.StatusCode, elapsed)
+}
+
+// RequireContentType sets the media type every response must have, like ExpectContentType,
+// unless a test expects or allows something else with ExpectContentType or AllowContentType.
+// Responses without content (204 No Content and 304 Not Modified) are exempt.
+// Set it to "" to stop requiring anything.
+func (h *HTTP) RequireContentType(mediaType string) {
+	h.contentType = mediaType
+}
+
+// DefaultErrorCodePath is the default JSON path of the error code checked by ExpectJSONError. See ErrorCodePath.
+const DefaultErrorCodePath = "error.code"
+
+// ErrorCodePath sets the JSON path of the error code in the API's error responses, as checked by ExpectJSONError,
+// for tests created after this is called. See ExpectJSONPathLength for the path syntax.
+// The default is DefaultErrorCodePath. Use "" to go back to it.
+func (h *HTTP) ErrorCodePath(path string) {
+	h.errorPath = path
+}
+
+// DefaultIdempotencyHeader is the default name of the request header set by WithIdempotencyKey. See IdempotencyHeader.
+const DefaultIdempotencyHeader = "Idempotency-Key"
+
+// IdempotencyHeader sets the name of the request header that WithIdempotencyKey sets,
+// for tests created after this is called, in case the API doesn't use the usual Idempotency-Key.
+// Use "" to go back to DefaultIdempotencyHeader.
+func (h *HTTP) IdempotencyHeader(name string) {
+	h.idemHeader = name
+}
+
+// DefaultMaxResponseSize is the default limit on the size of response bodies in bytes. See MaxResponseSize.
+const DefaultMaxResponseSize = 32 << 20
+
+// MaxResponseSize sets the limit on the size of response bodies in bytes, as sent over the wire.
+// Reading stops at the limit and the test fails, so a handler that sends a huge or endless body can't hang the tests
+// or run them out of memory. The default is DefaultMaxResponseSize. Use 0 or less for no limit.
+// Streamed bodies, read by ExpectStream and ExpectSSE, are not limited. See also ExpectMaxBodySize.
+func (h *HTTP) MaxResponseSize(n int64) {
+	if n <= 0 {
+		n = -1
+	}
+	h.sizeLimit = n
+}
+
+func (h HTTP) newTestCase(method string, path string, opts []TestOption) *testCase {
+	tc := newTestCase(h.url(), h.httpClient(), method, path, opts)
+	tc.verbose = h.verbose
+	tc.capture = h.capture
+	tc.trace = h.trace
+	if tc.jar == nil {
+		tc.jar = h.jar
+	}
+	switch {
+	case h.sizeLimit > 0:
+		tc.sizeLimit = h.sizeLimit
+	case h.sizeLimit < 0:
+		tc.sizeLimit = 0
+	}
+	if h.errorPath != "" {
+		tc.errorPath = h.errorPath
+	}
+	if h.idemHeader != "" {
+		tc.idemHeader = h.idemHeader
+	}
+	if h.contentType != "" && !tc.skipSuiteType {
+		tc.requireContentType(h.contentType)
+	}
+	return tc
+}
+
+func newTestCase(baseURL string, client *http.Client, method string, path string, opts []TestOption) *testCase {
+	tc := &testCase{
+		baseURL:       baseURL,
+		baseClient:    client,
+		method:        method,
+		path:          path,
+		expectHeaders: make(map[string]string),
+		sizeLimit:     DefaultMaxResponseSize,
+	}
+	for _, opt := range opts {
+		opt(tc)
+	}
+	return tc
+}
+
+// Case is a single test for use with RunAll.
+type Case struct {
+	// Name of the subtest. If blank, a name is generated from the method and path.
+	Name   string
+	Method string
+	Path   string
+	Opts   []TestOption
+}
+
+// RunAll runs each case as a subtest of t.
+func (h HTTP) RunAll(t *testing.T, cases []Case) {
+	t.Helper()
+	for _, c := range cases {
+		opts := c.Opts
+		if c.Name != "" {
+			opts = append([]TestOption{WithName(c.Name)}, opts...)
+		}
+		h.Run(t, c.Method, c.Path, opts...)
+	}
+}
+
+// Run runs a test as a subtest of t, named after its method and path like "GET /users".
+// The name can be changed with WithName.
+func (h HTTP) Run(t *testing.T, method, path string, opts ...TestOption) bool {
+	t.Helper()
+	tc := h.newTestCase(method, path, opts)
+	name := tc.name
+	if name == "" {
+		name = fmt.Sprintf("%s %s", method, path)
+	}
+	return t.Run(name, tc.fn())
+}
+
+type testCase struct {
+	baseURL       string
+	baseClient    *http.Client
+	method        string
+	path          string
+	mutateReq     []func(*http.Request)
+	tamper        []func(*http.Request)
+	input         io.Reader
+	inputFunc     func() io.Reader
+	body          []byte
+	form          url.Values
+	jar           *cookiejar.Jar
+	expectCode    int
+	expectRaw     []byte
+	expectJSON    interface{}
+	outputCmpOpt  []cmp.Option
+	expectHeaders map[string]string
+	grabOutput    interface{}
+	fatalFailure  *testing.T
+	parallel      bool
+	noRedirects   bool
+	expectTime    time.Duration
+	grabTime      *time.Duration
+	rawBody       bool
+	expectGzip    bool
+	dumpOnFailure bool
+	pathParams    map[string]string
+	checks        []check
+	readsBody     bool
+	stream        func() func(*testing.T, []byte) bool
+	streamTimeout time.Duration
+	streams       int
+	repeat        int
+	repeatCodes   []int
+	grabResp      **http.Response
+	tlsConfig     *tls.Config
+	attempts      int
+	retryInterval time.Duration
+	name          string
+	failAfter     time.Duration
+	colorDiff     bool
+	maxBodySize   int64
+	sizeLimit     int64
+	idempotent    bool
+	loadErrors    bool
+	trace         *tracer
+	grabStats     *Stats
+	transport     http.RoundTripper
+	cassette      *cassetteTransport
+	raw           *rawTransport
+	allowedTypes  []string
+	errorPath     string
+	idemHeader    string
+	// skips the suite's RequireContentType
+	skipSuiteType bool
+	verbose       bool
+	capture       *capturer
+	// an option that couldn't be applied
+	optErr error
+}
+
+// checkBody adds a check that examines the response body.
+func (tc *testCase) checkBody(c check) {
+	tc.checks = append(tc.checks, c)
+	tc.readsBody = true
+}
+
+// buffersBody reports whether any options need the whole response body.
+func (tc *testCase) buffersBody() bool {
+	return tc.readsBody || tc.expectRaw != nil || tc.expectJSON != nil || tc.grabOutput != nil || tc.expectGzip ||
+		tc.grabResp != nil || tc.dumpOnFailure
+}
+
+// check examines the result of a test, returning an error describing why it failed.
+type check func(res *result) error
+
+// result is the outcome of a test's request.
+type result struct {
+	t       *testing.T
+	req     *http.Request
+	resp    *http.Response
+	body    []byte
+	elapsed time.Duration
+}
+
+// client returns a copy of the base client for this test to configure as it pleases.
+func (tc *testCase) client() *http.Client {
+	base := tc.baseClient
+	client := &http.Client{
+		Transport:     base.Transport,
+		CheckRedirect: base.CheckRedirect,
+		Timeout:       base.Timeout,
+	}
+	if tc.transport != nil {
+		client.Transport = tc.transport
+	}
+	if tc.jar != nil {
+		client.Jar = tc.jar
+	}
+	if tc.noRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if tc.expectGzip {
+		// the transport transparently decompresses gzip and hides the header, so turn that off
+		modifyTransport(client, func(tr *http.Transport) {
+			tr.DisableCompression = true
+		})
+	}
+	if tc.tlsConfig != nil {
+		modifyTransport(client, func(tr *http.Transport) {
+			cfg := tc.tlsConfig.Clone()
+			if base := tr.TLSClientConfig; base != nil {
+				// keep trusting the test server and speaking its protocols
+				if cfg.RootCAs == nil {
+					cfg.RootCAs = base.RootCAs
+				}
+				if cfg.NextProtos == nil {
+					cfg.NextProtos = base.NextProtos
+				}
+			}
+			tr.TLSClientConfig = cfg
+		})
+	}
+	if tc.raw != nil {
+		if tr, ok := client.Transport.(*http.Transport); ok {
+			tc.raw.tlsConfig = tr.TLSClientConfig
+		}
+		client.Transport = tc.raw
+	}
+	if tc.cassette != nil {
+		// wrap the transport last, so the other options can still modify it
+		ct := *tc.cassette
+		if ct.next = client.Transport; ct.next == nil {
+			ct.next = http.DefaultTransport
+		}
+		client.Transport = &ct
+	}
+	return client
+}
+
+// modifyTransport replaces the client's transport with a modified copy.
+// Custom transports are left alone, as they can't be modified.
+func modifyTransport(client *http.Client, modify func(*http.Transport)) {
+	var tr *http.Transport
+	switch rt := client.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = rt.Clone()
+	default:
+		return
+	}
+	modify(tr)
+	client.Transport = tr
+}
+
+func (tc *testCase) fn() func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		if tc.parallel {
+			t.Parallel()
+		}
+
+		if tc.optErr != nil {
+			t.Fatalf("[%s %s] %v", tc.method, tc.path, tc.optErr)
+		}
+
+		if tc.streams > 1 {
+			t.Fatalf("[%s %s] only one of ExpectStream or ExpectSSE can be used", tc.method, tc.path)
+		}
+		if tc.stream != nil && tc.buffersBody() {
+			t.Fatalf("[%s %s] ExpectStream and ExpectSSE can't be combined with options that need the whole response body", tc.method, tc.path)
+		}
+
+		client := tc.client()
+		defer client.CloseIdleConnections()
+
+		req, err := tc.newRequest()
+		if err != nil {
+			t.Fatalf("[%s %s] %v", tc.method, tc.path, err)
+		}
+
+		for attempt := 1; ; attempt++ {
+			final := attempt >= tc.attempts
+			rep := &report{method: tc.method, path: tc.path, color: tc.colorDiff}
+			if final {
+				rep.fatal = tc.fatalFailure
+			}
+			tc.send(t, client, req, rep)
+			if final || len(rep.failures) == 0 {
+				rep.flush(t)
+				return
+			}
+			t.Logf("[%s %s] attempt %d of %d failed with %d failed expectations, retrying in %v", tc.method, tc.path, attempt, tc.attempts, len(rep.failures), tc.retryInterval)
+			time.Sleep(tc.retryInterval)
+			if req, err = cloneRequest(req); err != nil {
+				t.Fatalf("[%s %s] can't retry request: %v", tc.method, tc.path, err)
+			}
+		}
+	}
+}
+
+// newRequest builds the request for this test.
+func (tc *testCase) newRequest() (*http.Request, error) {
+	path := tc.path
+	if tc.pathParams != nil {
+		var err error
+		if path, err = expandPath(path, tc.pathParams); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(tc.method, tc.baseURL+path, tc.requestBody())
+	if err != nil {
+		return nil, err
+	}
+	if tc.inputFunc != nil {
+		// lets the client send the body again when following 307 and 308 redirects or retrying
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(tc.inputFunc()), nil
+		}
+	}
+	tc.mutate(req)
+	return req, nil
+}
+
+// send sends req and checks the response, recording failures in rep.
+func (tc *testCase) send(t *testing.T, client *http.Client, req *http.Request, rep *report) {
+	t.Helper()
+
+	// send all but the last repeated request here, the last one is examined as usual
+	repeat := tc.repeat
+	if tc.idempotent && repeat < 2 {
+		repeat = 2
+	}
+	var firstCode int
+	var firstBody []byte
+	for i := 0; i < repeat-1; i++ {
+		start := time.Now()
+		resp, err := tc.do(t, client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.trace != nil {
+			tc.trace.log(req, resp, time.Since(start))
+		}
+		body, err := tc.readBody(resp.Body)
+		if err == errTooLarge {
+			rep.fail("request %d of %d: %v", i+1, repeat, tc.tooLarge())
+		} else if err != nil {
+			rep.fail("request %d of %d: error reading body: %v", i+1, repeat, err)
+		}
+		if i == 0 && tc.idempotent {
+			// compared with the final body, which is cut off at the same size limit
+			firstCode, firstBody = resp.StatusCode, body
+		}
+		resp.Body.Close()
+		tc.checkRepeatCode(rep, i, resp.StatusCode)
+		if req, err = cloneRequest(req); err != nil {
+			t.Fatalf("[%s %s] can't repeat request: %v", tc.method, tc.path, err)
+		}
+	}
+
+	start := time.Now()
+	resp, err := tc.do(t, client, req)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.trace != nil {
+		tc.trace.log(req, resp, elapsed)
+	}
+	if tc.grabTime != nil {
+		*tc.grabTime = elapsed
+	}
+	defer resp.Body.Close()
+
+	var encoded, gotRaw []byte
+	if tc.stream != nil {
+		if err := readStream(t, resp.Body, tc.streamTimeout, tc.stream()); err != nil {
+			rep.fail("%v", err)
+		}
+	} else {
+		if encoded, err = tc.readBody(resp.Body); err == errTooLarge {
+			rep.fail("%v", tc.tooLarge())
+		} else if err != nil {
+			rep.fail("error reading body: %v", err)
+		}
+		gotRaw = encoded
+		// empty bodies, like those of HEAD requests and 304 responses, can keep the Content-Encoding of the full response
+		if !tc.rawBody && len(encoded) > 0 && req.Method != http.MethodHead {
+			if gotRaw, err = decompress(resp.Header.Get("Content-Encoding"), encoded); err != nil {
+				rep.fail("error decompressing body: %v", err)
+			}
+		}
+		if tc.verbose {
+			t.Log("output:\n", string(gotRaw))
+		} else {
+			rep.output = func() {
+				t.Helper()
+				t.Log("output:\n", string(gotRaw))
+			}
+		}
+	}
+
+	if tc.grabStats != nil {
+		*tc.grabStats = Stats{
+			StatusCode: resp.StatusCode,
+			BodySize:   int64(len(encoded)),
+			Duration:   elapsed,
+			Proto:      resp.Proto,
+		}
+	}
+
+	if tc.dumpOnFailure {
+		rep.onFailure = append(rep.onFailure, func() {
+			t.Helper()
+			dump(t, req, resp, gotRaw)
+		})
+	}
+
+	if tc.expectCode != 0 && resp.StatusCode != tc.expectCode {
+		rep.fail("unexpected response code: want %v, got %v", tc.expectCode, resp.StatusCode)
+	}
+	if tc.repeat > 0 {
+		tc.checkRepeatCode(rep, tc.repeat-1, resp.StatusCode)
+	}
+	if tc.idempotent {
+		if resp.StatusCode != firstCode {
+			rep.fail("response code changed when repeated: first %v, then %v", firstCode, resp.StatusCode)
+		}
+		if tc.stream == nil && !bytes.Equal(firstBody, encoded) {
+			rep.fail("response body changed when repeated:\nfirst: %s\nthen: %s", firstBody, encoded)
+		}
+	}
+
+	if tc.expectTime != 0 && elapsed > tc.expectTime {
+		rep.fail("response took too long: want at most %v, got %v", tc.expectTime, elapsed)
+	}
+
+	headerNames := make([]string, 0, len(tc.expectHeaders))
+	for k := range tc.expectHeaders {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+	var headerMismatch bool
+	for _, k := range headerNames {
+		if v, got := tc.expectHeaders[k], resp.Header.Get(k); got != v {
+			rep.fail("unexpected response header (%s): want %v, got %v", k, v, got)
+			headerMismatch = true
+		}
+	}
+	if headerMismatch {
+		rep.onFailure = append(rep.onFailure, func() {
+			t.Helper()
+			t.Logf("header dump: %#v", resp.Header)
+		})
+	}
+
+	if tc.expectGzip {
+		if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+			rep.fail("unexpected response header (Content-Encoding): want gzip, got %v", enc)
+		} else if _, err := decompress(enc, encoded); err != nil {
+			rep.fail("response body is not valid gzip: %v", err)
+		}
+	}
+
+	if tc.expectRaw != nil {
+		if !bytes.Equal(tc.expectRaw, gotRaw) {
+			rep.fail("raw output mismatch:\nwant: %s\ngot: %s", string(tc.expectRaw), string(gotRaw))
+		}
+	}
+
+	if tc.expectJSON != nil {
+		outptr := reflect.New(reflect.TypeOf(tc.expectJSON))
+		if err := json.Unmarshal(gotRaw, outptr.Interface()); err != nil {
+			rep.fail("couldn't decode JSON output: %v", err)
+		} else {
+			output := outptr.Elem().Interface()
+			if diff := cmp.Diff(tc.expectJSON, output, tc.outputCmpOpt...); diff != "" {
+				rep.fail("output mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	res := &result{
+		t:       t,
+		req:     req,
+		resp:    resp,
+		body:    gotRaw,
+		elapsed: elapsed,
+	}
+	for _, check := range tc.checks {
+		if err := check(res); err != nil {
+			rep.fail("%v", err)
+		}
+	}
+
+	if tc.grabOutput != nil {
+		if err := json.Unmarshal(gotRaw, tc.grabOutput); err != nil {
+			rep.fail("couldn't decode JSON output: %v", err)
+		}
+	}
+
+	if tc.grabResp != nil {
+		// the body has already been read, so give it a fresh one
+		resp.Body = ioutil.NopCloser(bytes.NewReader(gotRaw))
+		*tc.grabResp = resp
+	}
+}
+
+// do sends req, failing the test if FailAfter was given and there's no response in time.
+// Any in-flight request is canceled before failing.
+func (tc *testCase) do(t *testing.T, client *http.Client, req *http.Request) (*http.Response, error) {
+	t.Helper()
+	if tc.failAfter == 0 {
+		return client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	type response struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan response, 1)
+	go func() {
+		resp, err := client.Do(req.WithContext(ctx))
+		done <- response{resp, err}
+	}()
+
+	timer := time.NewTimer(tc.failAfter)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			cancel()
+			return nil, r.err
+		}
+		// cancel when the body is closed, as canceling now would cut the body short
+		r.resp.Body = cancelOnClose{ReadCloser: r.resp.Body, cancel: cancel}
+		return r.resp, nil
+	case <-timer.C:
+		cancel()
+		<-done
+		t.Fatalf("[%s %s] handler did not respond within %v", tc.method, tc.path, tc.failAfter)
+		return nil, nil
+	}
+}
+
+// cancelOnClose is a response body that cancels its request's context when closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// dump logs the request and response.
+// The response body must be given because it has already been read.
+func dump(t *testing.T, req *http.Request, resp *http.Response, body []byte) {
+	t.Helper()
+	dumpBody := true
+	if req.GetBody != nil {
+		// the original body has already been consumed, get a fresh one
+		if req.Body, _ = req.GetBody(); req.Body == nil {
+			dumpBody = false
+		}
+	} else if req.Body != nil {
+		dumpBody = false
+	}
+	if raw, err := httputil.DumpRequestOut(req, dumpBody); err == nil {
+		t.Logf("request dump:\n%s", raw)
+	} else {
+		t.Log("couldn't dump request:", err)
+	}
+
+	copied := *resp
+	copied.Body = ioutil.NopCloser(bytes.NewReader(body))
+	copied.ContentLength = int64(len(body))
+	if raw, err := httputil.DumpResponse(&copied, true); err == nil {
+		t.Logf("response dump:\n%s", raw)
+	} else {
+		t.Log("couldn't dump response:", err)
+	}
+}
+
+// mutate applies the options that modify the request, then those given to MutateRequest.
+func (tc *testCase) mutate(req *http.Request) {
+	for _, mut := range tc.mutateReq {
+		mut(req)
+	}
+	for _, mut := range tc.tamper {
+		mut(req)
+	}
+}
+
+// requestBody returns a reader for the input of this test.
+// Buffered input gets a fresh reader each time, so it can be sent again.
+func (tc *testCase) requestBody() io.Reader {
+	if tc.form != nil {
+		return strings.NewReader(tc.form.Encode())
+	}
+	if tc.body != nil {
+		return bytes.NewReader(tc.body)
+	}
+	if tc.inputFunc != nil {
+		return tc.inputFunc()
+	}
+	return tc.input
+}
+
+// setBody specifies buffered input for this test, replacing any previous input.
+func (tc *testCase) setBody(body []byte) {
+	tc.body = body
+	tc.input = nil
+	tc.inputFunc = nil
+	tc.form = nil
+}
+
+// addForm adds values to the form input of this test, replacing any other kind of input.
+func (tc *testCase) addForm(values url.Values) {
+	if tc.form == nil {
+		tc.setBody(nil)
+		tc.form = make(url.Values)
+	}
+	for k, vs := range values {
+		for _, v := range vs {
+			tc.form.Add(k, v)
+		}
+	}
+	tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	})
+}
+
+// checkRepeatCode checks the status code of the i-th repeated request.
+func (tc *testCase) checkRepeatCode(rep *report, i int, code int) {
+	if len(tc.repeatCodes) == 0 {
+		return
+	}
+	if want := tc.repeatCodes[i%len(tc.repeatCodes)]; code != want {
+		rep.fail("unexpected response code for request %d of %d: want %v, got %v", i+1, tc.repeat, want, code)
+	}
+}
+
+// cloneRequest returns a copy of req that can be sent again.
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("request body can't be read again")
+		}
+		var err error
+		if clone.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return clone, nil
+}
+
+// report collects the failed expectations of a test so they can be reported together.
+type report struct {
+	method    string
+	path      string
+	color     bool
+	fatal     *testing.T
+	failures  []string
+	output    func()
+	onFailure []func()
+}
+
+// fail records a failed expectation.
+// If the test was set up with FatalFailure, it fails immediately instead.
+func (r *report) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if r.color {
+		msg = colorize(msg)
+	}
+	if r.fatal != nil {
+		if r.output != nil {
+			r.output()
+		}
+		for _, fn := range r.onFailure {
+			fn()
+		}
+		r.fatal.Helper()
+		r.fatal.Fatalf("[%s %s] %s", r.method, r.path, msg)
+	}
+	r.failures = append(r.failures, msg)
+}
+
+// flush reports all failures at once.
+func (r *report) flush(t *testing.T) {
+	t.Helper()
+	if len(r.failures) == 0 {
+		return
+	}
+	if r.output != nil {
+		r.output()
+	}
+	switch len(r.failures) {
+	case 1:
+		t.Errorf("[%s %s] %s", r.method, r.path, r.failures[0])
+	default:
+		var b strings.Builder
+		fmt.Fprintf(&b, "[%s %s] %d expectations failed:", r.method, r.path, len(r.failures))
+		for i, msg := range r.failures {
+			fmt.Fprintf(&b, "\n%d. %s", i+1, strings.ReplaceAll(msg, "\n", "\n   "))
+		}
+		t.Error(b.String())
+	}
+	for _, fn := range r.onFailure {
+		fn()
+	}
+}
+
+// diffHeader precedes the cmp.Diff output in failure messages.
+const diffHeader = "(-want +got):\n"
+
+// colorize highlights the removed and added lines of the diff in msg, if it has one.
+func colorize(msg string) string {
+	i := strings.Index(msg, diffHeader)
+	if i < 0 {
+		return msg
+	}
+	i += len(diffHeader)
+	lines := strings.Split(msg[i:], "\n")
+	for j, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "-"):
+			lines[j] = "\x1b[31m" + line + "\x1b[0m"
+		case strings.HasPrefix(line, "+"):
+			lines[j] = "\x1b[32m" + line + "\x1b[0m"
+		}
+	}
+	return msg[:i] + strings.Join(lines, "\n")
+}
+
+var pathParamRegexp = regexp.MustCompile(`\{[^{}/]*\}`)
+
+// expandPath replaces {name} in path with the escaped value of params[name].
+func expandPath(path string, params map[string]string) (string, error) {
+	var missing []string
+	expanded := pathParamRegexp.ReplaceAllStringFunc(path, func(token string) string {
+		name := token[1 : len(token)-1]
+		value, ok := params[name]
+		if !ok {
+			missing = append(missing, token)
+			return token
+		}
+		return url.PathEscape(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing path params: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// lookupJSON finds the value at path in the given JSON data.
+// Paths are dot-separated object keys or array indexes, like "items.0.id".
+// An empty path refers to the whole document.
+// If the path doesn't exist, ok is false.
+func lookupJSON(data []byte, path string) (value json.RawMessage, ok bool, err error) {
+	if !json.Valid(data) {
+		// unmarshal to get a descriptive error
+		var v interface{}
+		return nil, false, json.Unmarshal(data, &v)
+	}
+	value = json.RawMessage(data)
+	if path == "" {
+		return value, true, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		trimmed := bytes.TrimSpace(value)
+		switch {
+		case len(trimmed) > 0 && trimmed[0] == '{':
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(trimmed, &obj); err != nil {
+				return nil, false, err
+			}
+			if value, ok = obj[key]; !ok {
+				return nil, false, nil
+			}
+		case len(trimmed) > 0 && trimmed[0] == '[':
+			var arr []json.RawMessage
+			if err := json.Unmarshal(trimmed, &arr); err != nil {
+				return nil, false, err
+			}
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(arr) {
+				return nil, false, nil
+			}
+			value = arr[i]
+		default:
+			return nil, false, nil
+		}
+	}
+	return value, true, nil
+}
+
+// displayPath returns a JSON path suitable for use in error messages.
+func displayPath(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return path
+}
+
+// lookupJSONArray finds the array at path in the given JSON data. See lookupJSON.
+func lookupJSONArray(data []byte, path string) ([]json.RawMessage, error) {
+	value, ok, err := lookupJSON(data, path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode JSON output: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("JSON path %q not found", path)
+	}
+	var arr []json.RawMessage
+	if err := json.Unmarshal(value, &arr); err != nil || arr == nil {
+		return nil, fmt.Errorf("JSON path %q is not an array: %s", path, value)
+	}
+	return arr, nil
+}
+
+// readStream calls fn for each line of body as it arrives, until fn returns false or body ends.
+// Reading stops with an error if that doesn't happen within timeout.
+func readStream(t *testing.T, body io.ReadCloser, timeout time.Duration, fn func(*testing.T, []byte) bool) error {
+	t.Helper()
+	lines := make(chan []byte)
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-stop:
+				return
+			}
+		}
+		done <- scanner.Err()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case line := <-lines:
+			t.Logf("stream: %s", line)
+			if !fn(t, line) {
+				// closing the body unblocks the scanner
+				body.Close()
+				return nil
+			}
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("error reading stream: %v", err)
+			}
+			return nil
+		case <-deadline.C:
+			body.Close()
+			return fmt.Errorf("stream timed out after %v", timeout)
+		}
+	}
+}
+
+// errTooLarge is returned by readBody for bodies over the size limit.
+var errTooLarge = errors.New("response body too large")
+
+// bodyLimit returns the most bytes of a response body this test reads, or 0 for no limit.
+func (tc *testCase) bodyLimit() int64 {
+	limit := tc.sizeLimit
+	if tc.maxBodySize > 0 && (limit <= 0 || tc.maxBodySize < limit) {
+		limit = tc.maxBodySize
+	}
+	return limit
+}
+
+// readBody reads a response body up to the size limit of this test.
+// If the body is over the limit, the bytes up to it are returned along with errTooLarge.
+func (tc *testCase) readBody(body io.Reader) ([]byte, error) {
+	limit := tc.bodyLimit()
+	if limit <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	// read one more byte to tell if there's too much
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		return data[:limit], errTooLarge
+	}
+	return data, err
+}
+
+// tooLarge returns the failure for a response body over the size limit of this test.
+func (tc *testCase) tooLarge() error {
+	limit := tc.bodyLimit()
+	if limit == tc.maxBodySize {
+		return fmt.Errorf("response body too large: want at most %d bytes, got more", limit)
+	}
+	return fmt.Errorf("response body exceeds the limit of %d bytes (see MaxResponseSize)", limit)
+}
+
+// decompress decodes body according to the given Content-Encoding.
+// Unknown encodings are returned as-is.
+func decompress(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case "deflate":
+		// deflate is supposed to be zlib-wrapped, but some servers send raw deflate data
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return body, nil
+}
+
+type TestOption func(*testCase)
+
+// Options combines several options into one, applied in order.
+// It lets other packages build options out of the existing ones.
+func Options(opts ...TestOption) TestOption {
+	return func(tc *testCase) {
+		for _, opt := range opts {
+			opt(tc)
+		}
+	}
+}
+
+// WithName specifies the name of this test for Run and RunAll.
+func WithName(name string) TestOption {
+	return func(tc *testCase) {
+		tc.name = name
+	}
+}
+
+// WithInput specifies the request body data for this test.
+// The reader is sent as-is, so unless it is a *bytes.Buffer, *bytes.Reader, or *strings.Reader,
+// it can only be sent once and won't work with Repeat.
+func WithInput(r io.Reader) TestOption {
+	return func(tc *testCase) {
+		tc.setBody(nil)
+		tc.input = r
+	}
+}
+
+// WithInputFunc specifies a function that returns a fresh request body each time it is called.
+// Like WithInput, the body is streamed as-is, but it can be sent again,
+// so it works with the options that need a buffered request body: Repeat, RetryUntil, Load, and ExpectEchoesInput,
+// as well as with 307 and 308 redirects. ExpectEchoesInput calls fn once more to get the body it compares with.
+func WithInputFunc(fn func() io.Reader) TestOption {
+	return func(tc *testCase) {
+		tc.setBody(nil)
+		tc.inputFunc = fn
+	}
+}
+
+// WithBody specifies the request body data for this test and sets the given Content-Type.
+// As with WithInput, the reader is sent as-is.
+// Like the other input options, the Content-Type can be overriden by a WithHeader or input option specified after this one.
+func WithBody(contentType string, r io.Reader) TestOption {
+	return func(tc *testCase) {
+		WithInput(r)(tc)
+
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Type", contentType)
+		})
+	}
+}
+
+// WithRawBody specifies the request body for this test as a string.
+func WithRawBody(body string) TestOption {
+	return WithRawBytes([]byte(body))
+}
+
+// WithRawBytes specifies the request body for this test.
+func WithRawBytes(body []byte) TestOption {
+	return func(tc *testCase) {
+		// copy so changes to the slice don't affect the test
+		tc.setBody(append([]byte{}, body...))
+	}
+}
+
+// WithGzipInput specifies the request body for this test, compressed with gzip, and sets the Content-Encoding: gzip header.
+// The reader is read and compressed up front, so the body can be sent again. Specify its Content-Type with WithHeader.
+func WithGzipInput(r io.Reader) TestOption {
+	return func(tc *testCase) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.Copy(zw, r); err != nil {
+			panic(err)
+		}
+		if err := zw.Close(); err != nil {
+			panic(err)
+		}
+		tc.setBody(buf.Bytes())
+
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Encoding", "gzip")
+		})
+	}
+}
+
+// WithInput specifies the JSON request body data for this test and expects application/json Content-Type.
+// The header expectation can be overriden with WithHeader.
+func WithJSONInput(input interface{}) TestOption {
+	return func(tc *testCase) {
+		raw, err := json.Marshal(input)
+		if err != nil {
+			panic(err)
+		}
+		tc.setBody(raw)
+
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Type", "application/json")
+		})
+	}
+}
+
+// WithJSONString specifies the request body for this test as literal JSON text and sets the application/json Content-Type.
+// Unlike WithJSONInput, body is sent as-is, so it can be malformed for testing how the server handles bad input.
+// The header can be overriden with WithHeader.
+func WithJSONString(body string) TestOption {
+	return func(tc *testCase) {
+		tc.setBody([]byte(body))
+
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Type", "application/json")
+		})
+	}
+}
+
+// WithInput specifies the form request body data for this test and expects application/x-www-form-urlencoded Content-Type.
+// The header expectation can be overriden with WithHeader.
+// It can be combined with WithFormValue, adding to the same form.
+func WithFormInput(values url.Values) TestOption {
+	return func(tc *testCase) {
+		tc.addForm(values)
+	}
+}
+
+// WithFormValue adds a value to the form request body data for this test and expects application/x-www-form-urlencoded Content-Type.
+// It can be specified multiple times and combined with WithFormInput to build up a form.
+func WithFormValue(key, value string) TestOption {
+	return func(tc *testCase) {
+		tc.addForm(url.Values{key: {value}})
+	}
+}
+
+// Multipart builds a multipart/form-data request body. Create one with MultipartBody.
+type Multipart struct {
+	parts []func(*multipart.Writer) error
+	err   error
+}
+
+// MultipartBody starts building a multipart/form-data request body.
+// Add fields and files to it, then use its Option method to get a TestOption:
+//
+//	tesuto.MultipartBody().
+//		Field("title", "cat").
+//		File("image", "cat.png", f).
+//		Option()
+func MultipartBody() *Multipart {
+	return &Multipart{}
+}
+
+// Field adds a form field.
+func (m *Multipart) Field(name, value string) *Multipart {
+	m.parts = append(m.parts, func(w *multipart.Writer) error {
+		return w.WriteField(name, value)
+	})
+	return m
+}
+
+// File adds a file with the given field name and filename, reading its contents from r.
+// The reader is read right away, so the body can be used by more than one test.
+func (m *Multipart) File(field, filename string, r io.Reader) *Multipart {
+	data, err := ioutil.ReadAll(r)
+	if err != nil && m.err == nil {
+		m.err = fmt.Errorf("can't read multipart file %q: %w", filename, err)
+	}
+	m.parts = append(m.parts, func(w *multipart.Writer) error {
+		part, err := w.CreateFormFile(field, filename)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(data)
+		return err
+	})
+	return m
+}
+
+// Option specifies the built multipart data as the request body for this test and sets the multipart/form-data Content-Type.
+// The header can be overriden with WithHeader. If a file couldn't be read, the test fails without sending a request.
+func (m *Multipart) Option() TestOption {
+	return func(tc *testCase) {
+		if m.err != nil {
+			tc.optErr = m.err
+			return
+		}
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		for _, part := range m.parts {
+			if err := part(w); err != nil {
+				tc.optErr = fmt.Errorf("can't build multipart body: %w", err)
+				return
+			}
+		}
+		if err := w.Close(); err != nil {
+			tc.optErr = fmt.Errorf("can't build multipart body: %w", err)
+			return
+		}
+		tc.setBody(buf.Bytes())
+
+		contentType := w.FormDataContentType()
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Type", contentType)
+		})
+	}
+}
+
+// WithHeader specifies a header to be added to the request for this test.
+// Content-Type, Referer, and User-Agent are replaced instead of added to, as a request has only one of each,
+// so they override the values set by options such as WithJSONInput, WithReferer, and WithUserAgent.
+// Host sets the request's host.
+func WithHeader(name, value string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			switch http.CanonicalHeaderKey(name) {
+			case "Content-Type", "Referer", "User-Agent":
+				// special case these to allow people to override WithXInput's automatic settings and the like
+				r.Header.Set(name, value)
+				return
+			case "Host":
+				// net/http ignores the Host header in favor of the request's Host field
+				r.Host = value
+				return
+			}
+			r.Header.Add(name, value)
+		})
+	}
+}
+
+// WithAccept adds a media type to the Accept header of the request for this test, for testing content negotiation.
+// It can be specified more than once to accept several types.
+func WithAccept(mediaType string) TestOption {
+	return WithHeader("Accept", mediaType)
+}
+
+// WithAcceptJSON accepts application/json, like WithAccept("application/json").
+func WithAcceptJSON() TestOption {
+	return WithAccept("application/json")
+}
+
+// WithReferer sets the Referer header of the request for this test.
+// Like the other header options, it can be overriden by a WithHeader specified after this one.
+func WithReferer(url string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Referer", url)
+		})
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the request for this test.
+// Like the other header options, it can be overriden by a WithHeader specified after this one.
+func WithUserAgent(ua string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("User-Agent", ua)
+		})
+	}
+}
+
+// WithIfNoneMatch sets the If-None-Match header of the request for this test to etag, for testing conditional requests.
+// See GrabETag.
+func WithIfNoneMatch(etag string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("If-None-Match", etag)
+		})
+	}
+}
+
+// WithRange requests the bytes from start to end, inclusive, by setting the Range header of the request for this test.
+// Use a negative end for an open-ended range to the end of the content, like "bytes=500-". See ExpectPartialContent.
+func WithRange(start, end int64) TestOption {
+	value := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		value += strconv.FormatInt(end, 10)
+	}
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Range", value)
+		})
+	}
+}
+
+// WithRawHeader adds a header value to the request for this test as-is, without canonicalizing its name
+// or replacing existing values. It is useful for sending duplicated or oddly-cased headers.
+func WithRawHeader(name, value string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header[name] = append(r.Header[name], value)
+		})
+	}
+}
+
+// MutateRequest specifies a function to modify the request for this test however it likes, for anything the other options can't do.
+// It runs after the modifications made by all other options, regardless of the order they're given in.
+func MutateRequest(fn func(*http.Request)) TestOption {
+	return func(tc *testCase) {
+		tc.tamper = append(tc.tamper, fn)
+	}
+}
+
+// WithIdempotencyKey sets the Idempotency-Key header of the request for this test,
+// or the header named by the suite's IdempotencyHeader. See ExpectIdempotent.
+func WithIdempotencyKey(key string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			name := tc.idemHeader
+			if name == "" {
+				name = DefaultIdempotencyHeader
+			}
+			r.Header.Set(name, key)
+		})
+	}
+}
+
+// ClockHeader is the name of the request header set by WithClock and read by ParseClock.
+const ClockHeader = "X-Test-Clock"
+
+// WithClock sets the ClockHeader header of the request for this test to now, formatted as RFC 3339 with nanoseconds,
+// so a handler under test can use it as the current time and responses can be compared exactly.
+// The handler must opt in to this, for example with ParseClock:
+//
+//	now := time.Now()
+//	if testing {
+//		if t, ok := tesuto.ParseClock(r); ok {
+//			now = t
+//		}
+//	}
+//
+// Don't trust the header outside of tests.
+func WithClock(now time.Time) TestOption {
+	value := now.Format(time.RFC3339Nano)
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set(ClockHeader, value)
+		})
+	}
+}
+
+// ParseClock returns the time set by WithClock in the ClockHeader header of r, if it has a valid one.
+func ParseClock(r *http.Request) (time.Time, bool) {
+	value := r.Header.Get(ClockHeader)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+// WithConnClose sends the request for this test with Connection: close, so the connection isn't kept alive.
+func WithConnClose() TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Close = true
+		})
+	}
+}
+
+// WithCookieJar specifies a cookie jar to use for this test, instead of the suite's jar (see ResetJar).
+func WithCookieJar(jar *cookiejar.Jar) TestOption {
+	return func(tc *testCase) {
+		tc.jar = jar
+	}
+}
+
+// FreshJar gives this test a new, empty cookie jar of its own, instead of the suite's jar (see ResetJar).
+func FreshJar() TestOption {
+	return func(tc *testCase) {
+		tc.jar = newJar()
+	}
+}
+
+func newJar() *cookiejar.Jar {
+	// New never returns an error
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// WithPathParams replaces {name} placeholders in the path with the corresponding URL-escaped values,
+// so paths like "/users/{id}" can be used. Placeholders without a value will fail the test.
+// Multiple calls are merged.
+func WithPathParams(params map[string]string) TestOption {
+	return func(tc *testCase) {
+		if tc.pathParams == nil {
+			tc.pathParams = make(map[string]string, len(params))
+		}
+		for k, v := range params {
+			tc.pathParams[k] = v
+		}
+	}
+}
+
+// WithHost specifies the Host of the request for this test, for testing virtual hosts and the like.
+func WithHost(host string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Host = host
+		})
+	}
+}
+
+// WithTrailer specifies a trailer to be sent after the request body for this test.
+// Requests with trailers are sent with chunked encoding.
+func WithTrailer(name, value string) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			if r.Trailer == nil {
+				r.Trailer = make(http.Header)
+			}
+			r.Trailer.Add(name, value)
+			// trailers are only sent with chunked bodies
+			r.ContentLength = -1
+			if r.Body == nil || r.Body == http.NoBody {
+				// an empty body would be sent without chunking
+				r.GetBody = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				}
+				r.Body, _ = r.GetBody()
+			}
+		})
+	}
+}
+
+// WithCookie specifies a cookie to be added to the request for this test.
+// Multiple cookies can be added by specifying this more than once.
+func WithCookie(c *http.Cookie) TestOption {
+	return func(tc *testCase) {
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.AddCookie(c)
+		})
+	}
+}
+
+// WithCookieValue specifies a cookie with the given name and value to be added to the request for this test.
+func WithCookieValue(name, value string) TestOption {
+	return WithCookie(&http.Cookie{Name: name, Value: value})
+}
+
+// WithTLSConfig specifies the TLS configuration of the client for this test, for client certificates and the like.
+// It is applied to a copy of the client's transport, so other tests are unaffected.
+// If cfg doesn't specify RootCAs, the server's certificate remains trusted.
+func WithTLSConfig(cfg *tls.Config) TestOption {
+	return func(tc *testCase) {
+		tc.tlsConfig = cfg
+	}
+}
+
+// WithTransport specifies the transport of the client for this test, in place of the server's,
+// for injecting faults or intercepting requests. Other tests are unaffected, as each test uses its own copy of the client.
+// A custom transport is responsible for trusting the server's certificate, so WithTLSConfig and ExpectGzipEncoded
+// only apply to it if it is an *http.Transport.
+func WithTransport(rt http.RoundTripper) TestOption {
+	return func(tc *testCase) {
+		tc.transport = rt
+	}
+}
+
+// NoFollowRedirects disables following redirects, so the redirect response itself is examined.
+func NoFollowRedirects() TestOption {
+	return func(tc *testCase) {
+		tc.noRedirects = true
+	}
+}
+
+// ExpectRedirectCount specifies the number of redirects that must be followed to get the response,
+// for catching extra hops or loops.
+func ExpectRedirectCount(n int) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			// each redirected request links to the redirect response that caused it
+			var got int
+			for req := res.resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+				got++
+			}
+			if got != n {
+				return fmt.Errorf("unexpected redirect count: want %d, got %d", n, got)
+			}
+			return nil
+		})
+	}
+}
+
+// RawBody disables automatic decompression of the response body.
+// By default, bodies with a Content-Encoding of gzip or deflate are decompressed before any expectations are checked.
+func RawBody() TestOption {
+	return func(tc *testCase) {
+		tc.rawBody = true
+	}
+}
+
+// ExpectStatusCode specifies the expected HTTP status code of the response.
+func ExpectStatusCode(code int) TestOption {
+	return func(tc *testCase) {
+		tc.expectCode = code
+	}
+}
+
+// ExpectNotStatusCode specifies an HTTP status code the response must not have, such as 500.
+// It can be specified more than once to forbid multiple codes.
+func ExpectNotStatusCode(code int) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			if res.resp.StatusCode == code {
+				return fmt.Errorf("unexpected response code: want anything but %v, got %v", code, res.resp.StatusCode)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectNotModified specifies that the response must be 304 Not Modified with an empty body.
+func ExpectNotModified() TestOption {
+	return func(tc *testCase) {
+		tc.expectCode = http.StatusNotModified
+		tc.checkBody(func(res *result) error {
+			if len(res.body) > 0 {
+				return fmt.Errorf("unexpected body for 304 Not Modified: %s", res.body)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectPartialContent specifies that the response must be 206 Partial Content with the bytes from start to end, inclusive,
+// out of total bytes. It checks the Content-Range header and the length of the body.
+func ExpectPartialContent(start, end, total int64) TestOption {
+	want := fmt.Sprintf("bytes %d-%d/%d", start, end, total)
+	return func(tc *testCase) {
+		tc.expectCode = http.StatusPartialContent
+		tc.expectHeaders["Content-Range"] = want
+		tc.checkBody(func(res *result) error {
+			if n := end - start + 1; int64(len(res.body)) != n {
+				return fmt.Errorf("unexpected partial content length: want %d, got %d", n, len(res.body))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectProto specifies the expected HTTP protocol version of the response, such as "HTTP/1.1" or "HTTP/2.0".
+func ExpectProto(want string) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			if res.resp.Proto != want {
+				return fmt.Errorf("unexpected response protocol: want %v, got %v", want, res.resp.Proto)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectStatusCode specifies an expected HTTP header of the response.
+func ExpectHeader(name, value string) TestOption {
+	return func(tc *testCase) {
+		tc.expectHeaders[name] = value
+	}
+}
+
+// ExpectHeaders specifies several expected HTTP headers of the response, like ExpectHeader for each of them.
+func ExpectHeaders(want map[string]string) TestOption {
+	return func(tc *testCase) {
+		for name, value := range want {
+			tc.expectHeaders[name] = value
+		}
+	}
+}
+
+// ExpectResponseTime specifies the maximum time the response may take to arrive.
+// This is the latency observed by the client, including the network and connection setup,
+// measured until the response headers are received. Leave a generous margin to avoid flaky tests.
+func ExpectResponseTime(max time.Duration) TestOption {
+	return func(tc *testCase) {
+		tc.expectTime = max
+	}
+}
+
+// ExpectMaxBodySize specifies the maximum size of the response body in bytes, as sent over the wire before any decompression.
+// At most n bytes are read, so the test fails without reading the rest of a huge body.
+// Expectations that examine the body see only the first n bytes of one that is too large.
+// The size of streamed bodies, with ExpectStream or ExpectSSE, is not checked.
+func ExpectMaxBodySize(n int64) TestOption {
+	return func(tc *testCase) {
+		tc.maxBodySize = n
+	}
+}
+
+// ExpectBody specifies a function to examine the response body, for anything the other options can't check.
+// It can use t to report failures as usual. They are reported along with the other failed expectations,
+// so only those of the last attempt count with RetryUntil. Fatal and FailNow stop the function, not the test.
+func ExpectBody(check func(t testing.TB, body []byte)) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			return runCheck(res.t, "body check", func(t testing.TB) {
+				check(t, res.body)
+			})
+		})
+	}
+}
+
+// ExpectResponse specifies a function to examine the response along with its body, which has already been read
+// and decompressed, for checks that need more than ExpectBody gives them. Failures are reported like those of ExpectBody.
+func ExpectResponse(check func(t testing.TB, resp *http.Response, body []byte)) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			return runCheck(res.t, "response check", func(t testing.TB) {
+				check(t, res.resp, res.body)
+			})
+		})
+	}
+}
+
+// checkT is the testing.TB given to user-supplied checks.
+// It records failures instead of failing the test, so they can be reported by the check.
+// Everything else, like logging, goes to the test.
+type checkT struct {
+	testing.TB
+	failed   bool
+	failures []string
+}
+
+// stopCheck is the panic used to stop a check that calls FailNow.
+type stopCheck struct{}
+
+func (t *checkT) Fail()        { t.failed = true }
+func (t *checkT) Failed() bool { return t.failed }
+
+func (t *checkT) FailNow() {
+	t.Fail()
+	panic(stopCheck{})
+}
+
+func (t *checkT) Error(args ...interface{}) {
+	t.failures = append(t.failures, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+	t.Fail()
+}
+
+func (t *checkT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+	t.Fail()
+}
+
+func (t *checkT) Fatal(args ...interface{}) {
+	t.Error(args...)
+	t.FailNow()
+}
+
+func (t *checkT) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	t.FailNow()
+}
+
+// runCheck calls check with a checkT and returns the failures it recorded as an error.
+func runCheck(t *testing.T, name string, check func(testing.TB)) error {
+	ct := &checkT{TB: t}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(stopCheck); !ok {
+					panic(r)
+				}
+			}
+		}()
+		check(ct)
+	}()
+	if !ct.failed {
+		return nil
+	}
+	if len(ct.failures) == 0 {
+		return fmt.Errorf("%s failed", name)
+	}
+	return fmt.Errorf("%s failed: %s", name, strings.Join(ct.failures, "\n"))
+}
+
+// ExpectValidUTF8 specifies that the response body must be valid UTF-8 text.
+func ExpectValidUTF8() TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			return checkUTF8(res.body)
+		})
+	}
+}
+
+// checkUTF8 returns an error describing the first invalid UTF-8 sequence in body, if any.
+func checkUTF8(body []byte) error {
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRune(body[i:])
+		if r == utf8.RuneError && size == 1 {
+			end := i + 4
+			if end > len(body) {
+				end = len(body)
+			}
+			return fmt.Errorf("invalid UTF-8 in response body at byte offset %d: %q", i, body[i:end])
+		}
+		i += size
+	}
+	return nil
+}
+
+// ExpectWellFormed specifies that the response body must be well-formed for its Content-Type:
+// JSON and XML must parse, and other text, including HTML, must be valid UTF-8 unless it declares another charset.
+// Other types, responses without a Content-Type, and the empty bodies of HEAD requests and 204 and 304 responses are not checked.
+func ExpectWellFormed() TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			header := res.resp.Header.Get("Content-Type")
+			if header == "" {
+				return nil
+			}
+			if code := res.resp.StatusCode; len(res.body) == 0 &&
+				(res.req.Method == http.MethodHead || code == http.StatusNoContent || code == http.StatusNotModified) {
+				return nil
+			}
+			mediaType, params, err := mime.ParseMediaType(header)
+			if err != nil {
+				return fmt.Errorf("invalid response header (Content-Type): %q: %v", header, err)
+			}
+			switch {
+			case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+				var v interface{}
+				if err := json.Unmarshal(res.body, &v); err != nil {
+					return fmt.Errorf("malformed JSON output (%s): %v", mediaType, err)
+				}
+			case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+				dec := xml.NewDecoder(bytes.NewReader(res.body))
+				for {
+					if _, err := dec.Token(); err == io.EOF {
+						break
+					} else if err != nil {
+						return fmt.Errorf("malformed XML output (%s): %v", mediaType, err)
+					}
+				}
+			case strings.HasPrefix(mediaType, "text/"):
+				if charset := params["charset"]; charset == "" || strings.EqualFold(charset, "utf-8") {
+					return checkUTF8(res.body)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectValidJSON specifies that the response must be valid JSON of any shape.
+func ExpectValidJSON() TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			var v json.RawMessage
+			if err := json.Unmarshal(res.body, &v); err != nil {
+				return fmt.Errorf("invalid JSON output: %v\nbody: %s", err, res.body)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONArrayLength specifies that the response must be a JSON array of length n.
+func ExpectJSONArrayLength(n int) TestOption {
+	return ExpectJSONPathLength("", n)
+}
+
+// ExpectJSONPathLength specifies that the response must have a JSON array of length n at the given path.
+// Paths are dot-separated object keys or array indexes, like "data.items" or "pages.0.items".
+func ExpectJSONPathLength(path string, n int) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			arr, err := lookupJSONArray(res.body, path)
+			if err != nil {
+				return err
+			}
+			if len(arr) != n {
+				return fmt.Errorf("unexpected JSON array length (%s): want %d, got %d", displayPath(path), n, len(arr))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONArrayLengthBetween specifies that the response must be a JSON array with a length from min to max, inclusive.
+func ExpectJSONArrayLengthBetween(min, max int) TestOption {
+	return ExpectJSONPathLengthBetween("", min, max)
+}
+
+// ExpectJSONPathLengthBetween specifies that the response must have a JSON array at the given path with a length from min to max, inclusive.
+// See ExpectJSONPathLength for the path syntax.
+func ExpectJSONPathLengthBetween(path string, min, max int) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			arr, err := lookupJSONArray(res.body, path)
+			if err != nil {
+				return err
+			}
+			if len(arr) < min || len(arr) > max {
+				return fmt.Errorf("unexpected JSON array length (%s): want between %d and %d, got %d", displayPath(path), min, max, len(arr))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONCountWhere specifies that the response must have a JSON array at the given path
+// with exactly n elements for which predicate returns true. See ExpectJSONPathLength for the path syntax.
+func ExpectJSONCountWhere(path string, predicate func(item json.RawMessage) bool, n int) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			arr, err := lookupJSONArray(res.body, path)
+			if err != nil {
+				return err
+			}
+			var count int
+			for _, item := range arr {
+				if predicate(item) {
+					count++
+				}
+			}
+			if count != n {
+				return fmt.Errorf("unexpected count of matching JSON array elements (%s): want %d, got %d of %d", displayPath(path), n, count, len(arr))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONNull specifies that the response must have an explicit JSON null at path, as opposed to no value or some other value.
+// See ExpectJSONPathLength for the path syntax.
+func ExpectJSONNull(path string) TestOption {
+	return expectJSONState(path, "null")
+}
+
+// ExpectJSONFieldAbsent specifies that the response must not have anything at path, not even null.
+// See ExpectJSONPathLength for the path syntax.
+func ExpectJSONFieldAbsent(path string) TestOption {
+	return expectJSONState(path, "absent")
+}
+
+// expectJSONState checks whether the value at path is "null", "absent", or some other "value".
+func expectJSONState(path string, want string) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			value, ok, err := lookupJSON(res.body, path)
+			if err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
+			}
+			got := "value"
+			switch {
+			case !ok:
+				got = "absent"
+			case jsonKind(value) == "null":
+				got = "null"
+			}
+			if got != want {
+				if got == "value" {
+					return fmt.Errorf("unexpected JSON value (%s): want %s, got %s", displayPath(path), want, value)
+				}
+				return fmt.Errorf("unexpected JSON value (%s): want %s, got %s", displayPath(path), want, got)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONSortedBy specifies that the response must have a JSON array at path whose elements are sorted
+// by the value at keyPath within each element, in ascending or descending order. Equal keys may be in any order.
+// Keys must be all strings or all numbers. See ExpectJSONPathLength for the path syntax.
+func ExpectJSONSortedBy(path string, keyPath string, ascending bool) TestOption {
+	order := "descending"
+	if ascending {
+		order = "ascending"
+	}
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			arr, err := lookupJSONArray(res.body, path)
+			if err != nil {
+				return err
+			}
+			keys := make([]interface{}, len(arr))
+			for i, item := range arr {
+				value, ok, err := lookupJSON(item, keyPath)
+				if err != nil || !ok {
+					return fmt.Errorf("JSON array element %d (%s) has no key at %q", i, displayPath(path), keyPath)
+				}
+				if err := json.Unmarshal(value, &keys[i]); err != nil {
+					return fmt.Errorf("couldn't decode JSON output: %v", err)
+				}
+				switch keys[i].(type) {
+				case string, float64:
+				default:
+					return fmt.Errorf("JSON array element %d (%s) key %q is not a string or number: %s", i, displayPath(path), keyPath, value)
+				}
+			}
+			for i := 1; i < len(keys); i++ {
+				prev, cur := keys[i-1], keys[i]
+				var outOfOrder bool
+				switch p := prev.(type) {
+				case string:
+					c, ok := cur.(string)
+					if !ok {
+						return fmt.Errorf("JSON array (%s) has mixed key types at %q: %v and %v", displayPath(path), keyPath, prev, cur)
+					}
+					outOfOrder = (ascending && c < p) || (!ascending && c > p)
+				case float64:
+					c, ok := cur.(float64)
+					if !ok {
+						return fmt.Errorf("JSON array (%s) has mixed key types at %q: %v and %v", displayPath(path), keyPath, prev, cur)
+					}
+					outOfOrder = (ascending && c < p) || (!ascending && c > p)
+				}
+				if outOfOrder {
+					return fmt.Errorf("JSON array (%s) not in %s order by %q: element %d (%v) is before element %d (%v)",
+						displayPath(path), order, keyPath, i-1, prev, i, cur)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONFieldType specifies that the response must have a JSON value of the given kind at path,
+// one of "string", "number", "bool", "array", "object", or "null". See ExpectJSONPathLength for the path syntax.
+func ExpectJSONFieldType(path string, kind string) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			value, ok, err := lookupJSON(res.body, path)
+			if err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
+			}
+			if !ok {
+				return fmt.Errorf("JSON path %q not found", path)
+			}
+			if got := jsonKind(value); got != kind {
+				return fmt.Errorf("unexpected JSON type (%s): want %v, got %v", displayPath(path), kind, got)
+			}
+			return nil
+		})
+	}
+}
+
+// jsonKind returns the kind of a valid JSON value, as used by ExpectJSONFieldType.
+func jsonKind(value json.RawMessage) string {
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) == 0 {
+		return ""
+	}
+	switch trimmed[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "bool"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// ExpectJSONError specifies that the response must be a JSON error with the given code,
+// found at "error.code" or the path set by the suite's ErrorCodePath. The rest of the error, such as its message, is ignored.
+func ExpectJSONError(code string) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			path := tc.errorPath
+			if path == "" {
+				path = DefaultErrorCodePath
+			}
+			value, ok, err := lookupJSON(res.body, path)
+			if err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
+			}
+			if !ok {
+				return fmt.Errorf("JSON error code (%s) not found in output: %s", path, res.body)
+			}
+			var got string
+			if err := json.Unmarshal(value, &got); err != nil {
+				return fmt.Errorf("JSON error code (%s) is not a string: %s", path, value)
+			}
+			if got != code {
+				return fmt.Errorf("unexpected JSON error code (%s): want %v, got %v", path, code, got)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectStream reads the response body line by line as it arrives, calling handler for each line.
+// Return false from handler to stop reading, allowing assertions on the start of a never-ending stream.
+// The test fails if the stream hasn't ended or been stopped within timeout.
+// It can't be combined with ExpectSSE or with options that need the whole response body,
+// such as ExpectJSONResponse, GrabResponse, and DumpOnFailure.
+func ExpectStream(timeout time.Duration, handler func(t *testing.T, line []byte) bool) TestOption {
+	return func(tc *testCase) {
+		tc.streams++
+		tc.stream = func() func(*testing.T, []byte) bool {
+			return handler
+		}
+		tc.streamTimeout = timeout
+	}
+}
+
+// SSEEvent is a server-sent event.
+type SSEEvent struct {
+	// Event is the event type. It is blank if not specified by the server.
+	Event string
+	// Data is the event data. Multiple data lines are joined with newlines.
+	Data string
+	// ID is the event ID. It is blank if not specified by the event.
+	ID string
+}
+
+// ExpectSSE reads the response as a text/event-stream, expecting the first events it receives to match events.
+// Comparison options can be specified.
+// The test fails if the expected number of events doesn't arrive within timeout.
+// Like ExpectStream, it can't be combined with ExpectStream or with options that need the whole response body.
+func ExpectSSE(timeout time.Duration, events []SSEEvent, compareOpt ...cmp.Option) TestOption {
+	return func(tc *testCase) {
+		tc.streams++
+		parser := new(sseParser)
+		tc.stream = func() func(*testing.T, []byte) bool {
+			// each stream is parsed from scratch, so retries don't see the events of earlier attempts
+			*parser = sseParser{}
+			return func(t *testing.T, line []byte) bool {
+				parser.feed(line)
+				return len(parser.events) < len(events)
+			}
+		}
+		tc.streamTimeout = timeout
+		tc.checks = append(tc.checks, func(*result) error {
+			if diff := cmp.Diff(events, parser.events, compareOpt...); diff != "" {
+				return fmt.Errorf("event stream mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		})
+	}
+}
+
+// sseParser parses a text/event-stream line by line.
+type sseParser struct {
+	events  []SSEEvent
+	current SSEEvent
+	data    []string
+}
+
+// feed parses a line of the stream, dispatching the current event if it is blank.
+func (p *sseParser) feed(line []byte) {
+	field, value := string(line), ""
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		field, value = field[:i], strings.TrimPrefix(field[i+1:], " ")
+	}
+	switch field {
+	case "":
+		if len(line) > 0 {
+			// comment
+			break
+		}
+		// blank line: dispatch the event
+		if len(p.data) > 0 {
+			p.current.Data = strings.Join(p.data, "\n")
+			p.events = append(p.events, p.current)
+		}
+		p.current, p.data = SSEEvent{}, nil
+	case "event":
+		p.current.Event = value
+	case "data":
+		p.data = append(p.data, value)
+	case "id":
+		p.current.ID = value
+	}
+}
+
+// ExpectHTMLAttr specifies that the first element of the HTML response matching selector
+// must have the given attribute with the value want.
+func ExpectHTMLAttr(selector, attr, want string) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			doc, err := goquery.NewDocumentFromReader(bytes.NewReader(res.body))
+			if err != nil {
+				return fmt.Errorf("couldn't parse HTML output: %v", err)
+			}
+			sel := doc.Find(selector).First()
+			if sel.Length() == 0 {
+				return fmt.Errorf("no HTML elements match selector %q", selector)
+			}
+			got, ok := sel.Attr(attr)
+			if !ok {
+				return fmt.Errorf("HTML element (%s) has no attribute %q", selector, attr)
+			}
+			if got != want {
+				return fmt.Errorf("unexpected HTML attribute (%s %s): want %v, got %v", selector, attr, want, got)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectGzipEncoded specifies that the response must be gzip compressed.
+// It checks the Content-Encoding header and that the body decodes successfully.
+// The client's transparent decompression is disabled for this test, so ask for compression
+// with WithHeader("Accept-Encoding", "gzip").
+func ExpectGzipEncoded() TestOption {
+	return func(tc *testCase) {
+		tc.expectGzip = true
+	}
+}
+
+// ExpectHeaderValues specifies all of the expected values of an HTTP header of the response, in any order.
+// It is useful for headers that may appear multiple times, such as Set-Cookie or Vary.
+func ExpectHeaderValues(name string, values []string) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			got := res.resp.Header.Values(name)
+			sorted := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+			if !cmp.Equal(values, got, sorted, cmpopts.EquateEmpty()) {
+				return fmt.Errorf("unexpected response header values (%s): want %q, got %q", name, values, got)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectContentType specifies the expected media type of the response's Content-Type header, such as "application/json".
+// Parameters like charset are ignored, and it overrides the suite's RequireContentType.
+func ExpectContentType(mediaType string) TestOption {
+	return func(tc *testCase) {
+		tc.skipSuiteType = true
+		tc.checks = append(tc.checks, func(res *result) error {
+			return checkContentType(res.resp, mediaType)
+		})
+	}
+}
+
+// AllowContentType lets the response of this test have any of the given media types
+// instead of the one required by the suite's RequireContentType.
+// With no arguments, any Content-Type is allowed.
+func AllowContentType(mediaTypes ...string) TestOption {
+	return func(tc *testCase) {
+		if len(mediaTypes) == 0 {
+			tc.skipSuiteType = true
+		}
+		tc.allowedTypes = append(tc.allowedTypes, mediaTypes...)
+	}
+}
+
+// requireContentType adds a check for the suite's required media type, or any of the allowed ones.
+func (tc *testCase) requireContentType(mediaType string) {
+	allowed := append([]string{mediaType}, tc.allowedTypes...)
+	tc.checks = append(tc.checks, func(res *result) error {
+		if code := res.resp.StatusCode; code == http.StatusNoContent || code == http.StatusNotModified {
+			return nil
+		}
+		var err error
+		for _, mt := range allowed {
+			if err = checkContentType(res.resp, mt); err == nil {
+				return nil
+			}
+		}
+		if len(allowed) > 1 {
+			return fmt.Errorf("unexpected response media type (Content-Type): want one of %v, got %v", allowed, res.resp.Header.Get("Content-Type"))
+		}
+		return err
+	})
+}
+
+// checkContentType checks that the response's Content-Type has the given media type.
+func checkContentType(resp *http.Response, mediaType string) error {
+	header := resp.Header.Get("Content-Type")
+	got, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return fmt.Errorf("invalid response header (Content-Type): want %v, got %q: %v", mediaType, header, err)
+	}
+	if !strings.EqualFold(got, mediaType) {
+		return fmt.Errorf("unexpected response media type (Content-Type): want %v, got %v", mediaType, header)
+	}
+	return nil
+}
+
+// ExpectCacheControl specifies directives the Cache-Control header of the response must have, like {"max-age": "60", "private": ""}.
+// Use an empty value for directives without one, such as no-store, to require that they are present.
+// Directive names are case-insensitive and other directives are ignored, as are their order and spacing.
+func ExpectCacheControl(directives map[string]string) TestOption {
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			header := strings.Join(res.resp.Header.Values("Cache-Control"), ", ")
+			got := parseCacheControl(header)
+			var mismatches []string
+			for _, name := range names {
+				want := directives[name]
+				value, ok := got[strings.ToLower(name)]
+				switch {
+				case !ok:
+					mismatches = append(mismatches, fmt.Sprintf("%s missing", name))
+				case value != want:
+					mismatches = append(mismatches, fmt.Sprintf("%s: want %q, got %q", name, want, value))
+				}
+			}
+			if len(mismatches) > 0 {
+				return fmt.Errorf("unexpected response header (Cache-Control): %s; got %q", strings.Join(mismatches, "; "), header)
+			}
+			return nil
+		})
+	}
+}
+
+// parseCacheControl parses the directives of a Cache-Control header into lower-case names and their unquoted values.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range splitHeaderList(header) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name, value = strings.TrimSpace(part[:i]), unquoteHeader(strings.TrimSpace(part[i+1:]))
+		}
+		directives[strings.ToLower(name)] = value
+	}
+	return directives
+}
+
+// splitHeaderList splits a comma-separated header value, ignoring commas inside quoted strings.
+func splitHeaderList(header string) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, header[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, header[start:])
+}
+
+// unquoteHeader returns the contents of a quoted string in a header value, or value as-is if it isn't quoted.
+func unquoteHeader(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var b strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		if value[i] == '\\' && i+1 < len(value)-1 {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// ExpectHeaderCount specifies that the response must have exactly n values for the given header,
+// for catching headers that are set more than once. Use 0 to expect the header to be absent.
+func ExpectHeaderCount(name string, n int) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			if got := res.resp.Header.Values(name); len(got) != n {
+				return fmt.Errorf("unexpected response header count (%s): want %d, got %d: %q", name, n, len(got), got)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectHeadersPresent specifies that the response must have all of the named headers, with any values.
+// Only their presence is checked: net/http doesn't keep the order headers arrive in,
+// so the order they appear on the wire can't be checked.
+func ExpectHeadersPresent(names ...string) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			var missing []string
+			for _, name := range names {
+				if len(res.resp.Header.Values(name)) == 0 {
+					missing = append(missing, name)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("missing response headers: %s", strings.Join(missing, ", "))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectLocationURL specifies a function to examine the Location header of the response,
+// parsed and resolved against the request URL. The test fails if there is no Location header.
+// It is useful with NoFollowRedirects for checking parts of a redirect, such as its query parameters.
+// Failures are reported like those of ExpectBody.
+func ExpectLocationURL(check func(t testing.TB, u *url.URL)) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			res.t.Helper()
+			u, err := res.resp.Location()
+			if err == http.ErrNoLocation {
+				return fmt.Errorf("missing response header (Location)")
+			}
+			if err != nil {
+				return fmt.Errorf("couldn't parse response header (Location): %v", err)
+			}
+			return runCheck(res.t, "Location check", func(t testing.TB) {
+				check(t, u)
+			})
+		})
+	}
 }
 
-// New creates a new test suite.
-func New(server *httptest.Server) HTTP {
-	return HTTP{
-		Server: server,
+// SecurityHeaders are the expected values of common security-related response headers.
+// Blank fields are not checked.
+type SecurityHeaders struct {
+	ContentTypeOptions      string // X-Content-Type-Options, usually "nosniff"
+	FrameOptions            string // X-Frame-Options
+	StrictTransportSecurity string // Strict-Transport-Security
+	ContentSecurityPolicy   string // Content-Security-Policy
+	ReferrerPolicy          string // Referrer-Policy
+}
+
+// ExpectSecurityHeaders specifies the expected values of the security headers of the response.
+// Only the headers set in cfg are checked.
+func ExpectSecurityHeaders(cfg SecurityHeaders) TestOption {
+	return func(tc *testCase) {
+		for _, h := range []struct{ name, value string }{
+			{"X-Content-Type-Options", cfg.ContentTypeOptions},
+			{"X-Frame-Options", cfg.FrameOptions},
+			{"Strict-Transport-Security", cfg.StrictTransportSecurity},
+			{"Content-Security-Policy", cfg.ContentSecurityPolicy},
+			{"Referrer-Policy", cfg.ReferrerPolicy},
+		} {
+			if h.value == "" {
+				continue
+			}
+			name, value := h.name, h.value
+			tc.checks = append(tc.checks, func(res *result) error {
+				if got := res.resp.Header.Get(name); got != value {
+					return fmt.Errorf("unexpected response header (%s): want %v, got %v", name, value, got)
+				}
+				return nil
+			})
+		}
 	}
 }
 
-// Test returns a test function suitable for running with t.Run.
-func (h HTTP) Test(method string, path string, opts ...TestOption) func(*testing.T) {
-	tc := &testCase{
-		server:        h.Server,
-		method:        method,
-		path:          path,
-		expectHeaders: make(map[string]string),
+// ExpectTrailer specifies an expected HTTP trailer of the response.
+func ExpectTrailer(name, value string) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			// trailers are available now that the body has been read
+			if got := res.resp.Trailer.Get(name); got != value {
+				return fmt.Errorf("unexpected response trailer (%s): want %v, got %v", name, value, got)
+			}
+			return nil
+		})
 	}
-	for _, opt := range opts {
-		opt(tc)
+}
+
+// ExpectCookieAbsent specifies that the response must not set the named cookie, unless it is expiring it.
+// This is useful for testing logout and the like.
+func ExpectCookieAbsent(name string) TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			for _, c := range res.resp.Cookies() {
+				if c.Name == name && !expired(c) {
+					return fmt.Errorf("unexpected cookie (%s): want absent or expired, got %v", name, c)
+				}
+			}
+			return nil
+		})
 	}
-	return tc.fn()
 }
 
-type testCase struct {
-	server        *httptest.Server
-	method        string
-	path          string
-	mutateReq     []func(*http.Request)
-	input         io.Reader
-	jar           *cookiejar.Jar
-	expectCode    int
-	expectRaw     []byte
-	expectJSON    interface{}
-	outputCmpOpt  []cmp.Option
-	expectHeaders map[string]string
-	grabOutput    interface{}
-	fatalFailure  *testing.T
+// ExpectNoCookies specifies that the response must not set any cookies.
+func ExpectNoCookies() TestOption {
+	return func(tc *testCase) {
+		tc.checks = append(tc.checks, func(res *result) error {
+			if cookies := res.resp.Cookies(); len(cookies) > 0 {
+				return fmt.Errorf("unexpected cookies: want none, got %v", cookies)
+			}
+			return nil
+		})
+	}
 }
 
-func (tc *testCase) fn() func(*testing.T) {
-	return func(t *testing.T) {
-		t.Helper()
+func expired(c *http.Cookie) bool {
+	return c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(time.Now()))
+}
 
-		client := tc.server.Client()
-		if tc.jar == nil {
-			client.Jar = nil
-		} else {
-			client.Jar = tc.jar
-		}
+// ExpectRawResponse specifies the exact body expected of the response.
+func ExpectRawResponse(body []byte) TestOption {
+	return func(tc *testCase) {
+		tc.expectRaw = body
+	}
+}
 
-		req, err := http.NewRequest(tc.method, tc.server.URL+tc.path, tc.input)
-		if err != nil {
-			t.Fatal(err)
-		}
-		for _, mut := range tc.mutateReq {
-			mut(req)
-		}
+// TextNormOption normalizes text before it is compared by ExpectTextEquals.
+type TextNormOption func(string) string
 
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer resp.Body.Close()
+// TrimSpace is a text normalization option that removes leading and trailing whitespace.
+func TrimSpace() TextNormOption {
+	return strings.TrimSpace
+}
 
-		gotRaw, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			t.Error("error reading body:", err)
-		}
-		t.Log("output:\n", string(gotRaw))
+// CollapseWhitespace is a text normalization option that replaces each run of whitespace, including newlines, with a single space.
+func CollapseWhitespace() TextNormOption {
+	return func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+}
 
-		fail := t.Errorf
-		if tc.fatalFailure != nil {
-			fail = tc.fatalFailure.Fatalf
-		}
+// ExpectTextEquals specifies the text expected of the response after both are normalized with the given options,
+// for text whose formatting may vary, such as rendered templates.
+// Without options, it is the same as ExpectRawResponse but reports a line-by-line diff.
+func ExpectTextEquals(want string, opts ...TextNormOption) TestOption {
+	for _, norm := range opts {
+		want = norm(want)
+	}
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			got := string(res.body)
+			for _, norm := range opts {
+				got = norm(got)
+			}
+			// compare lines, as cmp only diffs long strings line by line
+			if diff := cmp.Diff(strings.Split(want, "\n"), strings.Split(got, "\n")); diff != "" {
+				return fmt.Errorf("text output mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		})
+	}
+}
 
-		if tc.expectCode != 0 && resp.StatusCode != tc.expectCode {
-			fail("[%s %s] unexpected response code: want %v, got %v", tc.method, tc.path, tc.expectCode, resp.StatusCode)
-		}
+// ExpectEchoesInput specifies that the response body must be the same as the request body, for testing echo and proxy handlers.
+// The request body must be buffered or given by WithInputFunc, see WithInput.
+func ExpectEchoesInput() TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			var sent []byte
+			switch {
+			case tc.form != nil:
+				sent = []byte(tc.form.Encode())
+			case tc.body != nil:
+				sent = tc.body
+			case tc.inputFunc != nil:
+				var err error
+				if sent, err = ioutil.ReadAll(tc.inputFunc()); err != nil {
+					return fmt.Errorf("couldn't read request body: %v", err)
+				}
+			case tc.input != nil:
+				return fmt.Errorf("ExpectEchoesInput requires a buffered request body, see WithInput")
+			}
+			if !bytes.Equal(sent, res.body) {
+				return fmt.Errorf("response doesn't echo the request (-want +got):\n%s", cmp.Diff(string(sent), string(res.body)))
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONResponse specifies a JSON object that should match the response.
+// The response will be decoded into the same type as the specified output and compared.
+// Comparison options can be specified.
+// Times are compared with their Equal method, so 2020-01-01T00:00:00Z matches 2020-01-01T09:00:00+09:00.
+func ExpectJSONResponse(output interface{}, compareOpt ...cmp.Option) TestOption {
+	return func(tc *testCase) {
+		tc.expectJSON = output
+		tc.outputCmpOpt = compareOpt
+	}
+}
+
+// ExpectJSON specifies the expected HTTP status code of the response and a JSON object that should match it,
+// like ExpectStatusCode(code) and ExpectJSONResponse(output, compareOpt...) together.
+func ExpectJSON(code int, output interface{}, compareOpt ...cmp.Option) TestOption {
+	return func(tc *testCase) {
+		ExpectStatusCode(code)(tc)
+		ExpectJSONResponse(output, compareOpt...)(tc)
+	}
+}
 
-		for k, v := range tc.expectHeaders {
-			if got := resp.Header.Get(k); got != v {
-				fail("[%s %s] unexpected response header (%s): want %v, got %v", tc.method, tc.path, k, v, got)
-				t.Logf("header dump: %#v", resp.Header)
+var updateFiles = flag.Bool("tesuto.update", false, "update the expected JSON files of ExpectJSONFile with the actual responses")
+
+// ExpectJSONFile is like ExpectJSONResponse, but the expected JSON is read from the file at path.
+// The file and the response are both decoded into a value of the same type as into, and compared with the given options.
+// into is only used for its type, such as User{} or []Item(nil). If it is nil, JSON is compared as interface{} values.
+// Run the tests with the -tesuto.update flag to write the actual responses to the files instead.
+func ExpectJSONFile(path string, into interface{}, compareOpt ...cmp.Option) TestOption {
+	typ := reflect.TypeOf(into)
+	switch {
+	case typ == nil:
+		typ = reflect.TypeOf((*interface{})(nil)).Elem()
+	case typ.Kind() == reflect.Ptr:
+		typ = typ.Elem()
+	}
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			res.t.Helper()
+			if *updateFiles {
+				var buf bytes.Buffer
+				if err := json.Indent(&buf, res.body, "", "\t"); err != nil {
+					return fmt.Errorf("couldn't decode JSON output: %v", err)
+				}
+				buf.WriteByte('\n')
+				if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+					return fmt.Errorf("couldn't update expected JSON file: %v", err)
+				}
+				res.t.Logf("updated expected JSON file: %s", path)
+				return nil
 			}
-		}
 
-		if tc.expectRaw != nil {
-			if !bytes.Equal(tc.expectRaw, gotRaw) {
-				fail("[%s %s] raw output mismatch:\nwant: %s\ngot: %s", tc.method, tc.path, string(tc.expectRaw), string(gotRaw))
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("couldn't read expected JSON file: %v", err)
 			}
-		}
+			want := reflect.New(typ)
+			if err := json.Unmarshal(raw, want.Interface()); err != nil {
+				return fmt.Errorf("couldn't decode expected JSON file %s: %v", path, err)
+			}
+			got := reflect.New(typ)
+			if err := json.Unmarshal(res.body, got.Interface()); err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
+			}
+			if diff := cmp.Diff(want.Elem().Interface(), got.Elem().Interface(), compareOpt...); diff != "" {
+				return fmt.Errorf("output mismatch with %s (-want +got):\n%s", path, diff)
+			}
+			return nil
+		})
+	}
+}
 
-		if tc.expectJSON != nil {
-			outptr := reflect.New(reflect.TypeOf(tc.expectJSON))
-			if err := json.Unmarshal(gotRaw, outptr.Interface()); err != nil {
-				t.Fatal(err)
+// ExpectJSONResponseInto is like ExpectJSONResponse, but the response is decoded into out, which is left populated
+// for examining outside of the test, like GrabJSONResponse. Then it is compared to want.
+// It panics if out is not a pointer to the type of want.
+func ExpectJSONResponseInto(out interface{}, want interface{}, compareOpt ...cmp.Option) TestOption {
+	if outType, wantType := reflect.TypeOf(out), reflect.TypeOf(want); outType == nil || wantType == nil ||
+		outType.Kind() != reflect.Ptr || outType.Elem() != wantType {
+		panic(fmt.Sprintf("tesuto: ExpectJSONResponseInto: out must be a pointer to %v, got %v", wantType, outType))
+	}
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			if err := json.Unmarshal(res.body, out); err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
 			}
-			output := outptr.Elem().Interface()
-			if diff := cmp.Diff(tc.expectJSON, output, tc.outputCmpOpt...); diff != "" {
-				fail("[%s %s] output mismatch (-want +got):\n%s", tc.method, tc.path, diff)
+			if diff := cmp.Diff(want, reflect.ValueOf(out).Elem().Interface(), compareOpt...); diff != "" {
+				return fmt.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		})
+	}
+}
+
+// ExpectJSONResponseUnordered is like ExpectJSONResponse, but arrays of objects may be in any order.
+// Before comparing, the elements of each array in both output and the response are sorted by the key keyFunc returns for them,
+// so it should return something that identifies an element, such as its ID.
+// Elements are structs, maps, or pointers as found in output's type, or map[string]interface{} for interface{} fields.
+// Arrays of other things, such as strings, are compared in order.
+func ExpectJSONResponseUnordered(output interface{}, keyFunc func(interface{}) string, compareOpt ...cmp.Option) TestOption {
+	sorted := cmp.FilterPath(func(p cmp.Path) bool {
+		// don't sort what has just been sorted
+		for i := len(p) - 1; i >= 0; i-- {
+			switch step := p[i].(type) {
+			case cmp.TypeAssertion:
+				continue
+			case cmp.Transform:
+				return step.Name() != "SortByKey"
 			}
+			break
+		}
+		return true
+	}, cmp.FilterValues(func(x, y interface{}) bool {
+		return isObjectSlice(x) && isObjectSlice(y)
+	}, cmp.Transformer("SortByKey", func(x interface{}) interface{} {
+		rv := reflect.ValueOf(x)
+		keys := make([]string, rv.Len())
+		idx := make([]int, rv.Len())
+		for i := range keys {
+			keys[i] = keyFunc(rv.Index(i).Interface())
+			idx[i] = i
 		}
+		sort.SliceStable(idx, func(i, j int) bool { return keys[idx[i]] < keys[idx[j]] })
+		out := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i, j := range idx {
+			out.Index(i).Set(rv.Index(j))
+		}
+		return out.Interface()
+	})))
+	return ExpectJSONResponse(output, append([]cmp.Option{sorted}, compareOpt...)...)
+}
 
-		if tc.grabOutput != nil {
-			if err := json.Unmarshal(gotRaw, tc.grabOutput); err != nil {
-				t.Fatal(err)
+// isObjectSlice reports whether v is a slice of structs, maps, or pointers, or of interface{} values that are all objects.
+func isObjectSlice(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.IsNil() {
+		return false
+	}
+	switch rv.Type().Elem().Kind() {
+	case reflect.Struct, reflect.Map, reflect.Ptr:
+		return true
+	case reflect.Interface:
+		for i := 0; i < rv.Len(); i++ {
+			if _, ok := rv.Index(i).Interface().(map[string]interface{}); !ok {
+				return false
 			}
 		}
+		return true
 	}
+	return false
 }
 
-type TestOption func(*testCase)
+// DumpOnFailure logs the full request and response if any expectations fail.
+// The request body is included unless it was given to WithInput as a reader that can only be read once.
+func DumpOnFailure() TestOption {
+	return func(tc *testCase) {
+		tc.dumpOnFailure = true
+	}
+}
 
-// WithInput specifies the request body data for this test.
-func WithInput(r io.Reader) TestOption {
+// ExpectJSONEquivalent specifies JSON text that should be equivalent to the response,
+// regardless of formatting or the order of object keys.
+// Both are decoded into interface{} values, so all numbers are compared as float64.
+// It panics if want is not valid JSON.
+func ExpectJSONEquivalent(want string) TestOption {
+	return ExpectJSONResponseFrom(want)
+}
+
+// ExpectJSONResponseFrom is like ExpectJSONEquivalent, but comparison options can be specified.
+// Options that take field names work with object keys, so IgnoreField("user.id") ignores the id of {"user": {"id": 1}}.
+// It panics if wantJSON is not valid JSON.
+func ExpectJSONResponseFrom(wantJSON string, compareOpt ...cmp.Option) TestOption {
+	var want interface{}
+	if err := json.Unmarshal([]byte(wantJSON), &want); err != nil {
+		panic(err)
+	}
 	return func(tc *testCase) {
-		tc.input = r
+		tc.checkBody(func(res *result) error {
+			var got interface{}
+			if err := json.Unmarshal(res.body, &got); err != nil {
+				return fmt.Errorf("couldn't decode JSON output: %v", err)
+			}
+			if diff := cmp.Diff(want, got, compareOpt...); diff != "" {
+				return fmt.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		})
 	}
 }
 
-// WithInput specifies the JSON request body data for this test and expects application/json Content-Type.
-// The header expectation can be overriden with WithHeader.
-func WithJSONInput(input interface{}) TestOption {
+// GrabJSONResponse takes a pointer to an object and unmarshals the response into it.
+// Use this for examining data outside of the test.
+func GrabJSONResponse(out interface{}) TestOption {
 	return func(tc *testCase) {
-		raw, err := json.Marshal(input)
-		if err != nil {
-			panic(err)
-		}
-		tc.input = bytes.NewReader(raw)
+		tc.grabOutput = out
+	}
+}
 
-		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
-			r.Header.Set("Content-Type", "application/json")
+// GrabJSONStrict is like GrabJSONResponse, but the test fails if the response has fields that out doesn't,
+// for catching unexpected additions to the response.
+func GrabJSONStrict(out interface{}) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			dec := json.NewDecoder(bytes.NewReader(res.body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(out); err != nil {
+				return fmt.Errorf("couldn't strictly decode JSON output: %v", err)
+			}
+			return nil
 		})
 	}
 }
 
-// WithInput specifies the form request body data for this test and expects application/x-www-form-urlencoded Content-Type.
-// The header expectation can be overriden with WithHeader.
-func WithFormInput(values url.Values) TestOption {
+// GrabResponse takes a pointer to a response pointer and sets it to the response of this test.
+// Its body has already been read, so it is replaced with a copy of the (decompressed) body.
+// Use this for examining anything the other options don't cover, such as TLS state or trailers.
+func GrabResponse(out **http.Response) TestOption {
 	return func(tc *testCase) {
-		raw := values.Encode()
-		tc.input = strings.NewReader(raw)
+		tc.grabResp = out
+	}
+}
 
-		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
-			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// GrabHTML takes a pointer to a document pointer and sets it to the response parsed as HTML.
+// The test fails if the response can't be parsed.
+func GrabHTML(out **goquery.Document) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			doc, err := goquery.NewDocumentFromReader(bytes.NewReader(res.body))
+			if err != nil {
+				return fmt.Errorf("couldn't parse HTML output: %v", err)
+			}
+			*out = doc
+			return nil
 		})
 	}
 }
 
-// WithHeader specifies a header to be added to the request for this test.
-func WithHeader(name, value string) TestOption {
+// GrabJarCookies takes a pointer to a slice of cookies and sets it to the cookies held by this test's cookie jar
+// after the response has been received. Jars only give out cookies for a URL, so the request URL is used.
+// It requires a cookie jar: the test's own from WithCookieJar or FreshJar, or the suite's from ResetJar.
+func GrabJarCookies(out *[]*http.Cookie) TestOption {
 	return func(tc *testCase) {
-		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
-			// special case Content-Type to allow people to override WithXInput's automatic settings
-			if http.CanonicalHeaderKey(name) == "Content-Type" {
-				r.Header.Set(name, value)
-				return
+		tc.checks = append(tc.checks, func(res *result) error {
+			if tc.jar == nil {
+				return fmt.Errorf("GrabJarCookies requires a cookie jar (see WithCookieJar, FreshJar, and ResetJar)")
 			}
-			r.Header.Add(name, value)
+			*out = tc.jar.Cookies(res.req.URL)
+			return nil
 		})
 	}
 }
 
-func WithCookieJar(jar *cookiejar.Jar) TestOption {
+// GrabETag takes a pointer to a string and sets it to the ETag header of the response, as-is.
+// The test fails if there isn't one. Use it with WithIfNoneMatch to test caching:
+//
+//	var etag string
+//	t.Run("fetch", suite.GET("/doc", tesuto.GrabETag(&etag)))
+//	t.Run("cached", suite.GET("/doc", tesuto.WithIfNoneMatch(etag), tesuto.ExpectNotModified()))
+func GrabETag(out *string) TestOption {
 	return func(tc *testCase) {
-		tc.jar = jar
+		tc.checks = append(tc.checks, func(res *result) error {
+			etag := res.resp.Header.Get("ETag")
+			if etag == "" {
+				return fmt.Errorf("missing response header (ETag)")
+			}
+			*out = etag
+			return nil
+		})
 	}
 }
 
-// ExpectStatusCode specifies the expected HTTP status code of the response.
-func ExpectStatusCode(code int) TestOption {
+// GrabResponseTime takes a pointer to a duration and sets it to the time the response took to arrive.
+// See ExpectResponseTime for details on how it is measured.
+func GrabResponseTime(out *time.Duration) TestOption {
 	return func(tc *testCase) {
-		tc.expectCode = code
+		tc.grabTime = out
 	}
 }
 
-// ExpectStatusCode specifies an expected HTTP header of the response.
-func ExpectHeader(name, value string) TestOption {
+// Stats describes the response of a test, see GrabStats.
+type Stats struct {
+	StatusCode int
+	// BodySize is the size of the body in bytes as received, before any decompression.
+	// It is 0 for streamed bodies.
+	BodySize int64
+	// Duration is the time the response took to arrive, as in ExpectResponseTime.
+	Duration time.Duration
+	Proto    string
+}
+
+// GrabStats takes a pointer to Stats and sets it to the statistics of the response of this test,
+// for collecting metrics. It is set before any expectations are checked, so it is populated even if they fail.
+func GrabStats(out *Stats) TestOption {
 	return func(tc *testCase) {
-		tc.expectHeaders[name] = value
+		tc.grabStats = out
 	}
 }
 
-// ExpectRawResponse specifies the exact body expected of the response.
-func ExpectRawResponse(body []byte) TestOption {
+// Repeat sends the request n times, expecting the given status codes in order.
+// If there are fewer codes than requests, they are repeated from the start,
+// so Repeat(3, 200) expects all three requests to succeed.
+// The other expectations of the test apply to the last response.
+// The request body can only be sent again if it was buffered, see WithInput.
+func Repeat(n int, expectCodes ...int) TestOption {
 	return func(tc *testCase) {
-		tc.expectRaw = body
+		tc.repeat = n
+		tc.repeatCodes = expectCodes
 	}
 }
 
-// ExpectJSONResponse specifies a JSON object that should match the response.
-// The response will be decoded into the same type as the specified output and compared.
-// Comparison options can be specified.
-func ExpectJSONResponse(output interface{}, compareOpt ...cmp.Option) TestOption {
+// ExpectIdempotent sends the request twice, expecting the second response to have the same status code and body as the first.
+// Combine it with WithIdempotencyKey to test that duplicate requests are handled once.
+// The other expectations of the test apply to the second response. See Repeat for notes on request bodies.
+func ExpectIdempotent() TestOption {
 	return func(tc *testCase) {
-		tc.expectJSON = output
-		tc.outputCmpOpt = compareOpt
+		tc.idempotent = true
 	}
 }
 
-// GrabJSONResponse takes a pointer to an object and unmarshals the response into it.
-// Use this for examining data outside of the test.
-func GrabJSONResponse(out interface{}) TestOption {
+// RetryUntil sends the request again until all expectations pass, up to the given number of attempts,
+// waiting interval between each one. Only the failures of the last attempt are reported.
+// This is handy for endpoints that are eventually consistent.
+// Don't use it with requests that change things, as they may be sent more than once.
+// See Repeat for notes on request bodies.
+func RetryUntil(attempts int, interval time.Duration) TestOption {
 	return func(tc *testCase) {
-		tc.grabOutput = out
+		tc.attempts = attempts
+		tc.retryInterval = interval
 	}
 }
 
+// FailAfter fatally fails the test if the response headers haven't arrived within d,
+// so a handler that hangs doesn't block the rest of the suite.
+// The request is canceled, but the handler itself keeps running until it notices or returns.
+// With Repeat and RetryUntil, the limit applies to each request.
+func FailAfter(d time.Duration) TestOption {
+	return func(tc *testCase) {
+		tc.failAfter = d
+	}
+}
+
+// ColorDiff highlights removed and added lines in the diffs of failed comparisons, such as ExpectJSONResponse,
+// with terminal colors. It has no effect unless standard output is a terminal, or if the NO_COLOR environment variable is set,
+// so it is safe to leave on in CI.
+func ColorDiff() TestOption {
+	return func(tc *testCase) {
+		tc.colorDiff = colorTerminal()
+	}
+}
+
+// colorTerminal reports whether standard output is a terminal that colors can be used with.
+func colorTerminal() bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 // FatalFailure will make this fatally fail in the given test context.
 func FatalFailure(parentContext *testing.T) TestOption {
 	return func(tc *testCase) {
@@ -237,36 +2968,222 @@ func FatalFailure(parentContext *testing.T) TestOption {
 	}
 }
 
+// Parallel signals that this test is to be run in parallel with other parallel tests, like t.Parallel.
+// Each test uses its own copy of the server's client, but options that take shared state such as WithCookieJar
+// may still interact with other tests running at the same time.
+func Parallel() TestOption {
+	return func(tc *testCase) {
+		tc.parallel = true
+	}
+}
+
+// matchField reports whether the path to a node is the field called name for the field-based comparison options like IgnoreField.
+// Fields are matched by cmp.Path.String, which skips map keys, so "Users.Name" matches the Name of every User in a map[string]User,
+// or with string map keys included like struct fields, so "User.Name" also matches {"User": {"Name": ...}} decoded as a map.
+func matchField(p cmp.Path, name string) bool {
+	return p.String() == name || keyedPath(p) == name
+}
+
+// keyedPath returns the path to a node like cmp.Path.String, but including string map keys.
+func keyedPath(p cmp.Path) string {
+	var parts []string
+	for _, step := range p {
+		switch step := step.(type) {
+		case cmp.StructField:
+			parts = append(parts, step.Name())
+		case cmp.MapIndex:
+			if key := step.Key(); key.Kind() == reflect.String {
+				parts = append(parts, key.String())
+			}
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
 // NotEmpty is a comparison option that requires both things to not be empty. That is, different from their zero values.
+// Because both sides are checked, the expected value needs a non-zero placeholder for the field.
+// Despite the name, an empty but non-nil slice or map is not considered empty; see NonEmptySlice for that.
 func NotEmpty(name string) cmp.Option {
 	return cmp.FilterPath(func(p cmp.Path) bool {
-		return p.String() == name
+		return matchField(p, name)
 	}, cmp.FilterValues(func(x, y interface{}) bool {
 		return !reflect.DeepEqual(x, reflect.Zero(reflect.TypeOf(x)).Interface()) &&
 			!reflect.DeepEqual(y, reflect.Zero(reflect.TypeOf(y)).Interface())
 	}, cmp.Comparer(func(_, _ interface{}) bool { return true })))
 }
 
+// NotZero is a comparison option that requires both things to be different from their zero values.
+// It is the same as NotEmpty.
+func NotZero(name string) cmp.Option {
+	return NotEmpty(name)
+}
+
+// NonEmptySlice is a comparison option that requires both things to have a length greater than zero.
+// It works with slices, arrays, maps, and strings.
+// As with NotEmpty, the expected value needs a non-empty placeholder for the field.
+func NonEmptySlice(name string) cmp.Option {
+	return cmp.FilterPath(func(p cmp.Path) bool {
+		return matchField(p, name)
+	}, cmp.FilterValues(func(x, y interface{}) bool {
+		return hasLength(x) && hasLength(y)
+	}, cmp.Comparer(func(_, _ interface{}) bool { return true })))
+}
+
+func hasLength(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return rv.Len() > 0
+	}
+	return false
+}
+
+// MatchRegex is a comparison option that considers the given string field equal if the actual value matches pattern.
+// Leave the expected value of the field empty. An invalid pattern fails the comparison, showing the error in the diff.
+func MatchRegex(name, pattern string) cmp.Option {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return cmp.FilterPath(func(p cmp.Path) bool {
+			return matchField(p, name)
+		}, cmp.Options{
+			cmp.Transformer("MatchRegex", func(s string) invalidRegex {
+				return invalidRegex{Pattern: pattern, Error: err.Error(), Value: s}
+			}),
+			cmp.Comparer(func(_, _ invalidRegex) bool { return false }),
+		})
+	}
+	match := func(v interface{}) bool {
+		rv := reflect.ValueOf(v)
+		return rv.Kind() == reflect.String && re.MatchString(rv.String())
+	}
+	empty := func(v interface{}) bool {
+		rv := reflect.ValueOf(v)
+		return rv.Kind() == reflect.String && rv.Len() == 0
+	}
+	return cmp.FilterPath(func(p cmp.Path) bool {
+		return matchField(p, name)
+	}, cmp.Comparer(func(x, y interface{}) bool {
+		// cmp requires comparers to be symmetric, so the empty side is treated as the expected value
+		return (match(x) || empty(x)) && (match(y) || empty(y)) && (match(x) || match(y))
+	}))
+}
+
+// invalidRegex is what MatchRegex compares instead of strings when given an invalid pattern.
+type invalidRegex struct {
+	Pattern string
+	Error   string
+	Value   string
+}
+
+// EquateFold is a comparison option that compares the given string field case-insensitively, like strings.EqualFold.
+func EquateFold(name string) cmp.Option {
+	return cmp.FilterPath(func(p cmp.Path) bool {
+		return matchField(p, name)
+	}, cmp.Comparer(func(x, y interface{}) bool {
+		xv, yv := reflect.ValueOf(x), reflect.ValueOf(y)
+		if xv.Kind() != reflect.String || yv.Kind() != reflect.String {
+			return reflect.DeepEqual(x, y)
+		}
+		return strings.EqualFold(xv.String(), yv.String())
+	}))
+}
+
 // IgnoreField is a comparison option that ignores the given field, like "Foo" or "Foo.Bar".
 func IgnoreField(name string) cmp.Option {
 	return cmp.FilterPath(func(p cmp.Path) bool {
-		return p.String() == name
+		return matchField(p, name)
+	}, cmp.Ignore())
+}
+
+// IgnoreFields is a comparison option that ignores all of the given fields. See IgnoreField.
+func IgnoreFields(names ...string) cmp.Option {
+	ignore := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		ignore[name] = struct{}{}
+	}
+	return cmp.FilterPath(func(p cmp.Path) bool {
+		if _, ok := ignore[p.String()]; ok {
+			return true
+		}
+		_, ok := ignore[keyedPath(p)]
+		return ok
 	}, cmp.Ignore())
 }
 
+// IgnoreUnexported is a comparison option that ignores unexported fields of the given types. See cmpopts.IgnoreUnexported.
 func IgnoreUnexported(types ...interface{}) cmp.Option {
 	return cmpopts.IgnoreUnexported(types...)
 }
 
+// EquateApproxTime is a comparison option that considers times equal if they are within margin of each other.
+// Times are compared as instants, so their time zones don't matter. See cmpopts.EquateApproxTime.
 func EquateApproxTime(margin time.Duration) cmp.Option {
 	return cmpopts.EquateApproxTime(margin)
 }
 
+// EquateApproxFloat is a comparison option that considers floats equal if they are within
+// the given fraction of each other's magnitude or the given absolute margin. See cmpopts.EquateApprox.
+func EquateApproxFloat(fraction, margin float64) cmp.Option {
+	return cmpopts.EquateApprox(fraction, margin)
+}
+
+// EquateJSONNumbers is a comparison option that considers numbers equal if they have the same value,
+// whatever their types, including json.Number. This lets an expected int like 42 match the float64 42.0
+// that JSON numbers decode to as interface{} values.
+// Numbers of the same type are left to the other options, like EquateApproxFloat, unless they are json.Number.
+// Because cmp allows only one comparison per value, numbers of different types can't also be compared
+// by options like NotEmpty; give those a placeholder of the decoded type, such as -1.0 for a float64.
+func EquateJSONNumbers() cmp.Option {
+	return cmp.FilterValues(func(x, y interface{}) bool {
+		_, okx := jsonNumber(x)
+		_, oky := jsonNumber(y)
+		if !okx || !oky {
+			return false
+		}
+		_, numx := x.(json.Number)
+		_, numy := y.(json.Number)
+		return numx || numy || reflect.TypeOf(x) != reflect.TypeOf(y)
+	}, cmp.Comparer(func(x, y interface{}) bool {
+		nx, _ := jsonNumber(x)
+		ny, _ := jsonNumber(y)
+		return nx.Cmp(ny) == 0
+	}))
+}
+
+// jsonNumber returns the exact value of a number of any numeric type or json.Number.
+func jsonNumber(v interface{}) (*big.Float, bool) {
+	if n, ok := v.(json.Number); ok {
+		f, _, err := big.ParseFloat(string(n), 10, 256, big.ToNearestEven)
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Float).SetInt64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Float).SetUint64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) {
+			return nil, false
+		}
+		return big.NewFloat(f), true
+	}
+	return nil, false
+}
+
+// EquateEmpty is a comparison option that considers nil and empty slices or maps equal,
+// so a null JSON array matches an empty one. See cmpopts.EquateEmpty.
+func EquateEmpty() cmp.Option {
+	return cmpopts.EquateEmpty()
+}
+
+// SortSlices is a comparison option that sorts slices with lessFunc before comparing them. See cmpopts.SortSlices.
 func SortSlices(lessFunc interface{}) cmp.Option {
 	return cmpopts.SortSlices(lessFunc)
 }
 
-func ParseHTML(t *testing.T, body string) *goquery.Document {
+func ParseHTML(t testing.TB, body string) *goquery.Document {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
 	if err != nil {
 		t.Fatalf("couldn't parse HTML (error: %v)\n body:\n\t%s", err, body)
@@ -274,7 +3191,7 @@ func ParseHTML(t *testing.T, body string) *goquery.Document {
 	return doc
 }
 
-func ParseURL(t *testing.T, href string) *url.URL {
+func ParseURL(t testing.TB, href string) *url.URL {
 	url, err := url.Parse(href)
 	if err != nil {
 		t.Fatalf("couldn't parse URL (error: %v): %s", err, href)
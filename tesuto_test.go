@@ -0,0 +1,3358 @@
+package tesuto_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+	"github.com/guregu/tesuto"
+	"gopkg.in/yaml.v3"
+)
+
+// runTest runs test as a separate top-level test with verbose output,
+// so that it can fail without failing t, and returns whether it passed along with its output.
+// t fails if test doesn't finish within 10 seconds.
+func runTest(t *testing.T, test func(*testing.T)) (ok bool, output string) {
+	t.Helper()
+	name := strings.SplitN(t.Name(), "/", 2)[0]
+	match := func(pattern, str string) (bool, error) {
+		return regexp.MatchString(pattern, str)
+	}
+
+	verbose := flag.Lookup("test.v").Value.String()
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("test.v", "true")
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+		flag.Set("test.v", verbose)
+	}()
+
+	var buf bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(copied)
+	}()
+	finished := make(chan bool)
+	go func() {
+		finished <- testing.RunTests(match, []testing.InternalTest{{Name: name, F: test}})
+	}()
+	select {
+	case ok = <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("test didn't finish")
+	}
+	w.Close()
+	<-copied
+	return ok, buf.String()
+}
+
+// expectFailure runs test like runTest, fails t if it passes, and returns its output.
+func expectFailure(t *testing.T, test func(*testing.T)) string {
+	t.Helper()
+	ok, output := runTest(t, test)
+	if ok {
+		t.Errorf("test didn't fail, output:\n%s", output)
+	}
+	return output
+}
+
+// collapseSpace replaces runs of whitespace in s, including non-breaking spaces, with single spaces,
+// as cmp's diffs are deliberately inconsistent about them.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func TestRedirectIsolation(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "new")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("no follow", suite.Test(
+		"GET",
+		"/old",
+		tesuto.NoFollowRedirects(),
+		tesuto.ExpectStatusCode(http.StatusFound),
+		tesuto.ExpectHeader("Location", "/new"),
+	))
+
+	t.Run("follow", suite.Test(
+		"GET",
+		"/old",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("new")),
+	))
+
+	if server.Client().CheckRedirect != nil {
+		t.Error("server client was modified")
+	}
+}
+
+func TestExpectRedirectCount(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/b", http.StatusFound)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/c", http.StatusFound)
+	})
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "c")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("two hops", suite.GET("/a", tesuto.ExpectRedirectCount(2)))
+	t.Run("one hop", suite.GET("/b", tesuto.ExpectRedirectCount(1)))
+	t.Run("none", suite.GET("/c", tesuto.ExpectRedirectCount(0)))
+	t.Run("not followed", suite.GET("/a", tesuto.NoFollowRedirects(), tesuto.ExpectRedirectCount(0)))
+}
+
+func TestRunAll(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	suite.RunAll(t, []tesuto.Case{
+		{
+			Name:   "ping pongs",
+			Method: "GET",
+			Path:   "/ping",
+			Opts: []tesuto.TestOption{
+				tesuto.ExpectStatusCode(http.StatusOK),
+				tesuto.ExpectRawResponse([]byte("pong")),
+			},
+		},
+		{
+			Method: "GET",
+			Path:   "/missing",
+			Opts: []tesuto.TestOption{
+				tesuto.ExpectStatusCode(http.StatusNotFound),
+			},
+		},
+	})
+}
+
+func TestCookie(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lang := "en"
+		if c, err := r.Cookie("lang"); err == nil {
+			lang = c.Value
+		}
+		fmt.Fprintf(w, "%s %s", session.Value, lang)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("no cookie", suite.Test(
+		"GET",
+		"/whoami",
+		tesuto.ExpectStatusCode(http.StatusUnauthorized),
+	))
+
+	t.Run("with cookies", suite.Test(
+		"GET",
+		"/whoami",
+		tesuto.WithCookie(&http.Cookie{Name: "session", Value: "abc123"}),
+		tesuto.WithCookieValue("lang", "ja"),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("abc123 ja")),
+	))
+}
+
+func TestHost(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("a.example.com/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tenant a")
+	})
+	mux.HandleFunc("b.example.com/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tenant b")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("tenant a", suite.Test(
+		"GET",
+		"/",
+		tesuto.WithHost("a.example.com"),
+		tesuto.ExpectRawResponse([]byte("tenant a")),
+	))
+
+	t.Run("tenant b via header", suite.Test(
+		"GET",
+		"/",
+		tesuto.WithHeader("Host", "b.example.com"),
+		tesuto.ExpectRawResponse([]byte("tenant b")),
+	))
+
+	t.Run("unknown tenant", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectStatusCode(http.StatusNotFound),
+	))
+}
+
+func TestResponseTime(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var took time.Duration
+	t.Run("slow", suite.Test(
+		"GET",
+		"/slow",
+		tesuto.ExpectResponseTime(10*time.Second),
+		tesuto.GrabResponseTime(&took),
+	))
+	if took < 20*time.Millisecond {
+		t.Error("response time too short:", took)
+	}
+	out := expectFailure(t, suite.GET("/slow", tesuto.ExpectResponseTime(time.Millisecond)))
+	if !strings.Contains(out, "response took too long: want at most 1ms, got ") {
+		t.Error("slow response not reported:", out)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, "hello gzip")
+		zw.Close()
+	})
+	mux.HandleFunc("/deflate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		zw := zlib.NewWriter(w)
+		fmt.Fprint(zw, "hello deflate")
+		zw.Close()
+	})
+	mux.HandleFunc("/cached", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	mux.HandleFunc("/corrupt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		fmt.Fprint(w, "not gzip")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("gzip", suite.Test(
+		"GET",
+		"/gzip",
+		// setting Accept-Encoding ourselves stops the transport from decompressing for us
+		tesuto.WithHeader("Accept-Encoding", "gzip"),
+		tesuto.ExpectHeader("Content-Encoding", "gzip"),
+		tesuto.ExpectRawResponse([]byte("hello gzip")),
+	))
+
+	t.Run("deflate", suite.Test(
+		"GET",
+		"/deflate",
+		tesuto.ExpectHeader("Content-Encoding", "deflate"),
+		tesuto.ExpectRawResponse([]byte("hello deflate")),
+	))
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	fmt.Fprint(zw, "hello gzip")
+	zw.Close()
+	t.Run("raw gzip", suite.Test(
+		"GET",
+		"/gzip",
+		tesuto.WithHeader("Accept-Encoding", "gzip"),
+		tesuto.RawBody(),
+		tesuto.ExpectRawResponse(compressed.Bytes()),
+	))
+
+	// empty bodies aren't decompressed
+	t.Run("HEAD", suite.HEAD("/gzip",
+		tesuto.WithHeader("Accept-Encoding", "gzip"),
+		tesuto.ExpectStatusCode(http.StatusOK),
+	))
+	t.Run("not modified", suite.GET("/cached",
+		tesuto.WithHeader("Accept-Encoding", "gzip"),
+		tesuto.ExpectNotModified(),
+	))
+
+	out := expectFailure(t, suite.GET("/corrupt", tesuto.WithHeader("Accept-Encoding", "gzip")))
+	if !strings.Contains(out, "error decompressing body") {
+		t.Error("decompression error not reported:", out)
+	}
+}
+
+func TestExpectGzipEncoded(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fmt.Fprint(w, "plain")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, "compressed")
+		zw.Close()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("negotiates gzip", suite.Test(
+		"GET",
+		"/",
+		tesuto.WithHeader("Accept-Encoding", "gzip"),
+		tesuto.ExpectGzipEncoded(),
+		tesuto.ExpectRawResponse([]byte("compressed")),
+	))
+
+	t.Run("plain with identity encoding", suite.Test(
+		"GET",
+		"/",
+		tesuto.WithHeader("Accept-Encoding", "identity"),
+		tesuto.ExpectRawResponse([]byte("plain")),
+	))
+}
+
+func TestIgnoreFields(t *testing.T) {
+	type Item struct {
+		ID      string    `json:"id"`
+		Name    string    `json:"name"`
+		Created time.Time `json:"created"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/item", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Item{
+			ID:      fmt.Sprint(time.Now().UnixNano()),
+			Name:    "widget",
+			Created: time.Now(),
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("ignores generated fields", suite.Test(
+		"GET",
+		"/item",
+		tesuto.ExpectJSONResponse(Item{Name: "widget"}, tesuto.IgnoreFields("ID", "Created")),
+	))
+}
+
+func TestIgnoreFieldInMap(t *testing.T) {
+	type User struct {
+		ID   int
+		Name string
+	}
+	type Team struct {
+		Users map[string]User
+	}
+	want := Team{Users: map[string]User{"a": {ID: 1, Name: "greg"}}}
+	got := Team{Users: map[string]User{"a": {ID: 1, Name: "gregory"}}}
+
+	// struct fields are matched without map keys
+	if !cmp.Equal(want, got, tesuto.IgnoreField("Users.Name")) {
+		t.Error("IgnoreField didn't ignore a field of the structs in a map")
+	}
+	if !cmp.Equal(want, got, tesuto.IgnoreFields("Users.Name")) {
+		t.Error("IgnoreFields didn't ignore a field of the structs in a map")
+	}
+	// or with them
+	if !cmp.Equal(want, got, tesuto.IgnoreField("Users.a.Name")) {
+		t.Error("IgnoreField didn't ignore a field matched by map key")
+	}
+	if cmp.Equal(want, got, tesuto.IgnoreField("Users.b.Name")) {
+		t.Error("IgnoreField ignored a field of a different map key")
+	}
+}
+
+func TestNotZero(t *testing.T) {
+	type Post struct {
+		ID   int      `json:"id"`
+		Tags []string `json:"tags"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/post", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Post{
+			ID:   int(time.Now().Unix()),
+			Tags: []string{"go", "testing"},
+		})
+	})
+	mux.HandleFunc("/untagged", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Post{ID: 1, Tags: []string{}})
+	})
+	mux.HandleFunc("/unsaved", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Post{ID: 0, Tags: []string{"go"}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("generated ID and some tags", suite.Test(
+		"GET",
+		"/post",
+		tesuto.ExpectJSONResponse(Post{
+			ID:   -1,
+			Tags: []string{"placeholder"},
+		}, tesuto.NotZero("ID"), tesuto.NonEmptySlice("Tags")),
+	))
+
+	// NonEmptySlice doesn't match empty slices, so they are compared normally
+	t.Run("empty tags", suite.Test(
+		"GET",
+		"/untagged",
+		tesuto.ExpectJSONResponse(Post{
+			ID:   -1,
+			Tags: []string{},
+		}, tesuto.NotZero("ID"), tesuto.NonEmptySlice("Tags")),
+	))
+
+	out := expectFailure(t, suite.GET("/unsaved", tesuto.ExpectJSONResponse(Post{
+		ID:   -1,
+		Tags: []string{"placeholder"},
+	}, tesuto.NotZero("ID"), tesuto.NonEmptySlice("Tags"))))
+	if diff := collapseSpace(out); !strings.Contains(diff, "- ID: -1,") || !strings.Contains(diff, "+ ID: 0,") {
+		t.Error("zero ID not reported:", out)
+	}
+}
+
+func TestMatchRegex(t *testing.T) {
+	type Response struct {
+		RequestID string `json:"request_id"`
+		Status    string `json:"status"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Response{
+			RequestID: fmt.Sprintf("req-%d", time.Now().UnixNano()),
+			Status:    "ok",
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("request ID format", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectJSONResponse(Response{
+			Status: "ok",
+		}, tesuto.MatchRegex("RequestID", `^req-[0-9]+$`)),
+	))
+
+	opt := tesuto.MatchRegex("RequestID", `^req-[0-9]+$`)
+	if cmp.Equal(Response{}, Response{RequestID: "bogus"}, opt) {
+		t.Error("non-matching value was equal")
+	}
+	if cmp.Equal(Response{}, Response{}, opt) {
+		t.Error("missing value was equal")
+	}
+
+	invalid := tesuto.MatchRegex("RequestID", `(`)
+	if cmp.Equal(Response{}, Response{RequestID: "("}, invalid) {
+		t.Error("invalid pattern was equal")
+	}
+	if diff := cmp.Diff(Response{}, Response{RequestID: "req-1"}, invalid); !strings.Contains(diff, "missing closing )") {
+		t.Error("invalid pattern error not shown:", diff)
+	}
+}
+
+func TestEquateEmpty(t *testing.T) {
+	type List struct {
+		Items []string `json:"items"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"items": null}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("null equals empty", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectJSONResponse(List{Items: []string{}}, tesuto.EquateEmpty()),
+	))
+}
+
+func TestMultipartBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		contents, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%s %s %s %s", r.FormValue("title"), r.FormValue("tag"), header.Filename, contents)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("fields and file", suite.Test(
+		"POST",
+		"/upload",
+		tesuto.MultipartBody().
+			Field("title", "notes").
+			Field("tag", "todo").
+			File("file", "notes.txt", strings.NewReader("buy milk")).
+			Option(),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("notes todo notes.txt buy milk")),
+	))
+
+	t.Run("body can be reused", func(t *testing.T) {
+		body := tesuto.MultipartBody().
+			File("file", "notes.txt", strings.NewReader("buy eggs")).
+			Option()
+		for i := 0; i < 2; i++ {
+			suite.Run(t, "POST", "/upload", body,
+				tesuto.ExpectStatusCode(http.StatusOK),
+				tesuto.ExpectRawResponse([]byte("  notes.txt buy eggs")),
+			)
+		}
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		out := expectFailure(t, suite.Test("POST", "/upload",
+			tesuto.MultipartBody().
+				File("file", "notes.txt", iotest.ErrReader(errors.New("disk on fire"))).
+				Option(),
+		))
+		if !strings.Contains(out, `can't read multipart file "notes.txt": disk on fire`) {
+			t.Error("read error not reported:", out)
+		}
+	})
+}
+
+func TestPathParams(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.EscapedPath())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("params are substituted and escaped", suite.Test(
+		"GET",
+		"/users/{id}/posts/{postID}",
+		tesuto.WithPathParams(map[string]string{
+			"id":     "42",
+			"postID": "hello world/2",
+		}),
+		tesuto.ExpectRawResponse([]byte("/users/42/posts/hello%20world%2F2")),
+	))
+
+	out := expectFailure(t, suite.GET(
+		"/users/{id}/posts/{postID}/{commentID}",
+		tesuto.WithPathParams(map[string]string{"id": "42"}),
+	))
+	if !strings.Contains(out, "[GET /users/{id}/posts/{postID}/{commentID}] missing path params: {postID}, {commentID}") {
+		t.Error("leftover params not reported:", out)
+	}
+}
+
+func TestJSONArrayLength(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1},{"id":2},{"id":3}]`)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":{"items":[1,2]},"pages":[{"items":[]}]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("top-level array", suite.Test(
+		"GET",
+		"/list",
+		tesuto.ExpectJSONArrayLength(3),
+	))
+
+	t.Run("nested arrays", suite.Test(
+		"GET",
+		"/page",
+		tesuto.ExpectJSONPathLength("data.items", 2),
+		tesuto.ExpectJSONPathLength("pages.0.items", 0),
+	))
+
+	out := expectFailure(t, suite.GET("/list", tesuto.ExpectJSONArrayLength(2)))
+	if !strings.Contains(out, "unexpected JSON array length (root): want 2, got 3") {
+		t.Error("length mismatch not reported:", out)
+	}
+	out = expectFailure(t, suite.GET("/page", tesuto.ExpectJSONPathLength("data.items", 3)))
+	if !strings.Contains(out, "unexpected JSON array length (data.items): want 3, got 2") {
+		t.Error("nested length mismatch not reported:", out)
+	}
+
+	t.Run("bounds", suite.Test(
+		"GET",
+		"/list",
+		tesuto.ExpectJSONArrayLengthBetween(1, 3),
+	))
+
+	t.Run("path bounds", suite.Test(
+		"GET",
+		"/page",
+		tesuto.ExpectJSONPathLengthBetween("data.items", 2, 10),
+		tesuto.ExpectJSONPathLengthBetween("pages.0.items", 0, 0),
+	))
+
+	out = expectFailure(t, suite.GET("/list", tesuto.ExpectJSONArrayLengthBetween(4, 10)))
+	if !strings.Contains(out, "unexpected JSON array length (root): want between 4 and 10, got 3") {
+		t.Error("too short array not reported:", out)
+	}
+	out = expectFailure(t, suite.GET("/page", tesuto.ExpectJSONPathLengthBetween("data.items", 0, 1)))
+	if !strings.Contains(out, "unexpected JSON array length (data.items): want between 0 and 1, got 2") {
+		t.Error("too long array not reported:", out)
+	}
+}
+
+func TestExpectStream(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, `{"n":%d}`+"\n", i); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var got []int
+	t.Run("first three events", suite.Test(
+		"GET",
+		"/events",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectHeader("Content-Type", "application/x-ndjson"),
+		tesuto.ExpectStream(5*time.Second, func(t *testing.T, line []byte) bool {
+			var event struct {
+				N int `json:"n"`
+			}
+			if err := json.Unmarshal(line, &event); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, event.N)
+			return len(got) < 3
+		}),
+	))
+	if !cmp.Equal(got, []int{0, 1, 2}) {
+		t.Error("unexpected events:", got)
+	}
+
+	stop := func(t *testing.T, line []byte) bool { return false }
+	for _, test := range []struct {
+		opt  tesuto.TestOption
+		want string
+	}{
+		{tesuto.ExpectSSE(time.Second, nil), "only one of ExpectStream or ExpectSSE can be used"},
+		{tesuto.ExpectRawResponse([]byte("x")), "can't be combined with options that need the whole response body"},
+		{tesuto.GrabResponse(new(*http.Response)), "can't be combined with options that need the whole response body"},
+		{tesuto.DumpOnFailure(), "can't be combined with options that need the whole response body"},
+	} {
+		out := expectFailure(t, suite.GET("/events", tesuto.ExpectStream(time.Second, stop), test.opt))
+		if !strings.Contains(out, test.want) {
+			t.Errorf("want failure %q, got: %s", test.want, out)
+		}
+	}
+}
+
+func TestExpectSSE(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": welcome\n\n")
+		fmt.Fprint(w, "data: hello\n\n")
+		fmt.Fprint(w, "event: update\nid: 2\ndata: line one\ndata: line two\n\n")
+		w.(http.Flusher).Flush()
+		// keep the stream open
+		<-r.Context().Done()
+	})
+	var mu sync.Mutex
+	var n int
+	mux.HandleFunc("/count", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n++
+		fmt.Fprintf(w, "data: %d\n\n", n)
+		mu.Unlock()
+	})
+	var stalls int
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		stalls++
+		first := stalls == 1
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		if first {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, "data: ok\n\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("events", suite.Test(
+		"GET",
+		"/events",
+		tesuto.ExpectHeader("Content-Type", "text/event-stream"),
+		tesuto.ExpectSSE(5*time.Second, []tesuto.SSEEvent{
+			{Data: "hello"},
+			{Event: "update", ID: "2", Data: "line one\nline two"},
+		}),
+	))
+
+	// each attempt and run reads its own events
+	retried := suite.GET("/count",
+		tesuto.RetryUntil(3, time.Millisecond),
+		tesuto.ExpectSSE(5*time.Second, []tesuto.SSEEvent{{Data: "3"}}),
+	)
+	t.Run("retried", retried)
+	mu.Lock()
+	n = 0
+	mu.Unlock()
+	t.Run("rerun", retried)
+
+	// a stream that times out is retried like any other failure
+	t.Run("recovers from timeout", suite.GET("/stall",
+		tesuto.RetryUntil(3, time.Millisecond),
+		tesuto.ExpectSSE(100*time.Millisecond, []tesuto.SSEEvent{{Data: "ok"}}),
+	))
+}
+
+func TestDial(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	if _, resp, err := suite.Dial("/echo"); err == nil {
+		t.Error("expected handshake to fail without authorization")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("unexpected handshake response:", resp, err)
+	}
+
+	conn, resp, err := suite.Dial("/echo", tesuto.WithHeader("Authorization", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Error("unexpected status code:", resp.StatusCode)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Errorf("unexpected echo: %q", msg)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	var mu sync.Mutex
+	var hits int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		hits++
+		if hits > 5 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	var truncated int
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		truncated++
+		if truncated == 1 {
+			// promise more than is sent, so reading the body fails
+			w.Header().Set("Content-Length", "10")
+		}
+		fmt.Fprint(w, "ok")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("rate limited after 5 requests", suite.Test(
+		"GET",
+		"/limited",
+		tesuto.Repeat(6, 200, 200, 200, 200, 200, 429),
+	))
+
+	for _, opt := range []tesuto.TestOption{tesuto.Repeat(2), tesuto.ExpectIdempotent()} {
+		mu.Lock()
+		truncated = 0
+		mu.Unlock()
+		out := expectFailure(t, suite.GET("/truncated", opt))
+		if !strings.Contains(out, "request 1 of 2: error reading body: unexpected EOF") {
+			t.Error("read error of a repeated request not reported:", out)
+		}
+	}
+}
+
+func TestRepeatBody(t *testing.T) {
+	type Message struct {
+		Text string `json:"text"`
+	}
+
+	var mu sync.Mutex
+	var got []Message
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, msg)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("post twice", suite.Test(
+		"POST",
+		"/messages",
+		tesuto.WithJSONInput(Message{Text: "hello"}),
+		tesuto.Repeat(2, http.StatusCreated),
+	))
+
+	if want := []Message{{"hello"}, {"hello"}}; !cmp.Equal(want, got) {
+		t.Error("unexpected messages:", got)
+	}
+}
+
+func TestExpectValidJSON(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": %q}`, time.Now().String())
+	})
+	mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"error": oops}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("error is JSON", suite.Test(
+		"GET",
+		"/error",
+		tesuto.ExpectStatusCode(http.StatusBadRequest),
+		tesuto.ExpectValidJSON(),
+	))
+
+	t.Run("invalid", func(t *testing.T) {
+		out := expectFailure(t, suite.GET("/garbage", tesuto.ExpectValidJSON()))
+		if !strings.Contains(out, "invalid JSON output: invalid character 'o' looking for beginning of value") {
+			t.Error("parse error not reported:", out)
+		}
+		if !strings.Contains(out, `body: {"error": oops}`) {
+			t.Error("body not reported:", out)
+		}
+	})
+}
+
+func TestYAML(t *testing.T) {
+	type Config struct {
+		Name     string   `yaml:"name"`
+		Replicas int      `yaml:"replicas"`
+		Ports    []int    `yaml:"ports"`
+		Labels   []string `yaml:"labels,omitempty"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/yaml" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var cfg Config
+		if err := yaml.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.Labels = append(cfg.Labels, "applied")
+		w.Header().Set("Content-Type", "application/yaml")
+		yaml.NewEncoder(w).Encode(cfg)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("roundtrip", suite.Test(
+		"POST",
+		"/config",
+		tesuto.WithYAMLInput(Config{Name: "web", Replicas: 3, Ports: []int{80, 443}}),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectHeader("Content-Type", "application/yaml"),
+		tesuto.ExpectYAMLResponse(Config{
+			Name:     "web",
+			Replicas: 3,
+			Ports:    []int{80, 443},
+			Labels:   []string{"applied"},
+		}),
+	))
+}
+
+func TestGrabResponse(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "body")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var resp *http.Response
+	t.Run("grab", suite.Test(
+		"GET",
+		"/",
+		tesuto.GrabResponse(&resp),
+	))
+	if resp == nil {
+		t.Fatal("response not grabbed")
+	}
+	if resp.ProtoMajor != 1 {
+		t.Error("unexpected protocol:", resp.Proto)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "body" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+const testPage = `<!doctype html>
+<html>
+<head><title>Sign in</title></head>
+<body>
+<form action="/login" method="post">
+<input type="hidden" name="csrf" value="token123">
+<input type="text" name="user">
+</form>
+<a id="signup" href="/signup?ref=login">Sign up</a>
+</body>
+</html>`
+
+func TestGrabHTML(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testPage)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var doc *goquery.Document
+	t.Run("login page", suite.Test(
+		"GET",
+		"/login",
+		tesuto.GrabHTML(&doc),
+	))
+	if doc == nil {
+		t.Fatal("document not grabbed")
+	}
+	if title := doc.Find("title").Text(); title != "Sign in" {
+		t.Errorf("unexpected title: %q", title)
+	}
+
+	t.Run("attributes", suite.Test(
+		"GET",
+		"/login",
+		tesuto.ExpectHTMLAttr("input[name=csrf]", "value", "token123"),
+		tesuto.ExpectHTMLAttr("#signup", "href", "/signup?ref=login"),
+		tesuto.ExpectHTMLAttr("form", "method", "post"),
+	))
+
+	for _, test := range []struct {
+		opt  tesuto.TestOption
+		want string
+	}{
+		{tesuto.ExpectHTMLAttr("#missing", "href", "/"), `no HTML elements match selector "#missing"`},
+		{tesuto.ExpectHTMLAttr("form", "enctype", "multipart/form-data"), `HTML element (form) has no attribute "enctype"`},
+		{tesuto.ExpectHTMLAttr("form", "method", "get"), "unexpected HTML attribute (form method): want get, got post"},
+	} {
+		if out := expectFailure(t, suite.GET("/login", test.opt)); !strings.Contains(out, test.want) {
+			t.Errorf("want failure %q, got: %s", test.want, out)
+		}
+	}
+}
+
+func TestEquateFold(t *testing.T) {
+	type Health struct {
+		Status string `json:"status"`
+		Region string `json:"region"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"ok","region":"us-east"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("status ignoring case", suite.Test(
+		"GET",
+		"/health",
+		tesuto.ExpectJSONResponse(Health{Status: "OK", Region: "us-east"}, tesuto.EquateFold("Status")),
+	))
+
+	if cmp.Equal(Health{Region: "US-EAST"}, Health{Region: "us-east"}, tesuto.EquateFold("Status")) {
+		t.Error("other fields should still be case-sensitive")
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("string", suite.Test(
+		"POST",
+		"/echo",
+		tesuto.WithRawBody("hello"),
+		tesuto.Repeat(2, http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("hello")),
+	))
+
+	t.Run("bytes", suite.Test(
+		"POST",
+		"/echo",
+		tesuto.WithRawBytes([]byte{0, 1, 2}),
+		tesuto.ExpectRawResponse([]byte{0, 1, 2}),
+	))
+}
+
+func TestWithBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "text/csv" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, strings.Count(string(body), "\n"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("csv", suite.Test(
+		"POST",
+		"/import",
+		tesuto.WithBody("text/csv", strings.NewReader("a,b\n1,2\n")),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("2")),
+	))
+
+	t.Run("overridden content type", suite.Test(
+		"POST",
+		"/import",
+		tesuto.WithBody("text/csv", strings.NewReader("a,b\n")),
+		tesuto.WithHeader("Content-Type", "text/plain"),
+		tesuto.ExpectStatusCode(http.StatusUnsupportedMediaType),
+	))
+}
+
+func TestHandlerRecorder(t *testing.T) {
+	type Response struct {
+		Msg string `json:"msg"`
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/greet", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Response{Msg: "hello " + r.FormValue("name")})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	suite := tesuto.New(server)
+
+	var fromServer, fromHandler Response
+	opts := func(grab *Response) []tesuto.TestOption {
+		return []tesuto.TestOption{
+			tesuto.WithFormInput(url.Values{"name": {"greg"}}),
+			tesuto.ExpectStatusCode(http.StatusOK),
+			tesuto.ExpectHeader("Content-Type", "application/json"),
+			tesuto.ExpectJSONResponse(Response{Msg: "hello greg"}),
+			tesuto.GrabJSONResponse(grab),
+		}
+	}
+
+	t.Run("server", suite.Test("POST", "/greet", opts(&fromServer)...))
+	t.Run("handler", func(t *testing.T) {
+		tesuto.TestHandler(t, mux, "POST", "/greet", opts(&fromHandler)...)
+	})
+	if fromServer != fromHandler {
+		t.Errorf("server and handler results differ: %v ≠ %v", fromServer, fromHandler)
+	}
+
+	t.Run("wrong method", func(t *testing.T) {
+		tesuto.TestHandler(t, mux, "GET", "/greet", tesuto.ExpectStatusCode(http.StatusMethodNotAllowed))
+	})
+}
+
+func TestCookieAbsent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "", MaxAge: -1})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "", Expires: time.Unix(0, 0)})
+	})
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "en"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("logout expires cookies", suite.Test(
+		"POST",
+		"/logout",
+		tesuto.ExpectCookieAbsent("session"),
+		tesuto.ExpectCookieAbsent("theme"),
+	))
+
+	t.Run("no cookies", suite.Test(
+		"GET",
+		"/ping",
+		tesuto.ExpectNoCookies(),
+	))
+
+	out := expectFailure(t, suite.POST("/login", tesuto.ExpectCookieAbsent("session")))
+	if !strings.Contains(out, "unexpected cookie (session): want absent or expired, got session=abc") {
+		t.Error("present cookie not reported:", out)
+	}
+	out = expectFailure(t, suite.POST("/login", tesuto.ExpectNoCookies()))
+	if !strings.Contains(out, "unexpected cookies: want none, got [session=abc lang=en]") {
+		t.Error("present cookies not listed:", out)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	suite := tesuto.NewHTTP2(mux)
+	defer suite.Close()
+
+	var resp *http.Response
+	t.Run("uses HTTP/2", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectRawResponse([]byte("HTTP/2.0")),
+		tesuto.ExpectProto("HTTP/2.0"),
+		tesuto.GrabResponse(&resp),
+	))
+	if resp == nil || resp.ProtoMajor != 2 {
+		t.Error("response wasn't HTTP/2:", resp)
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	t.Run("uses HTTP/1.1", tesuto.New(server).GET(
+		"/",
+		tesuto.ExpectProto("HTTP/1.1"),
+	))
+}
+
+func TestTLSConfig(t *testing.T) {
+	// generate a self-signed client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("client certificate", suite.Test(
+		"GET",
+		"/",
+		tesuto.WithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{der},
+				PrivateKey:  key,
+			}},
+		}),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("client")),
+	))
+
+	if _, err := server.Client().Get(server.URL); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprintf(w, "%s %s", body, r.Trailer.Get("X-Sender"))
+		w.Header().Set("X-Checksum", fmt.Sprint(len(body)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("request and response trailers", suite.Test(
+		"POST",
+		"/upload",
+		tesuto.WithRawBody("data"),
+		tesuto.WithTrailer("X-Sender", "tesuto"),
+		tesuto.ExpectRawResponse([]byte("data tesuto")),
+		tesuto.ExpectTrailer("X-Checksum", "4"),
+	))
+
+	t.Run("recorder", func(t *testing.T) {
+		tesuto.TestHandler(t, mux, "POST", "/upload",
+			tesuto.WithRawBody("data"),
+			tesuto.WithTrailer("X-Sender", "tesuto"),
+			tesuto.ExpectRawResponse([]byte("data tesuto")),
+			tesuto.ExpectTrailer("X-Checksum", "4"),
+		)
+	})
+}
+
+func TestRetryUntil(t *testing.T) {
+	var mu sync.Mutex
+	var polls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/job", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		if polls < 3 {
+			fmt.Fprint(w, `{"status":"pending"}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"done"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("eventually done", suite.Test(
+		"GET",
+		"/job",
+		tesuto.RetryUntil(5, time.Millisecond),
+		tesuto.ExpectJSONResponse(map[string]string{"status": "done"}),
+	))
+	if polls != 3 {
+		t.Error("unexpected number of polls:", polls)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	ok, out := runTest(t, func(t *testing.T) {
+		t.Run("parallel", suite.GET("/", tesuto.Parallel()))
+		t.Run("serial", suite.GET("/"))
+	})
+	if !ok {
+		t.Error("test failed:", out)
+	}
+	// verbose output shows which tests paused to run in parallel
+	if !strings.Contains(out, "=== PAUSE TestParallel/parallel") || strings.Contains(out, "=== PAUSE TestParallel/serial") {
+		t.Error("Parallel didn't make only its test parallel:", out)
+	}
+}
+
+func TestDumpOnFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/widgets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "nope")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "bad widget")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	out := expectFailure(t, suite.POST("/widgets",
+		tesuto.DumpOnFailure(),
+		tesuto.WithJSONInput(map[string]int{"size": 1}),
+		tesuto.ExpectStatusCode(http.StatusCreated),
+	))
+	for _, want := range []string{"request dump:", "POST /widgets HTTP/1.1", `{"size":1}`, "response dump:", "X-Reason: nope", "bad widget"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in dump: %s", want, out)
+		}
+	}
+
+	// bodies that can only be read once are left out
+	out = expectFailure(t, suite.POST("/widgets",
+		tesuto.DumpOnFailure(),
+		tesuto.WithInput(iotest.OneByteReader(strings.NewReader("streamed"))),
+		tesuto.ExpectStatusCode(http.StatusCreated),
+	))
+	if !strings.Contains(out, "request dump:") || strings.Contains(out, "streamed") {
+		t.Error("unexpected dump of a streamed body:", out)
+	}
+}
+
+func TestReport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "1")
+		fmt.Fprint(w, "body text")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("all failures together", func(t *testing.T) {
+		out := expectFailure(t, suite.GET("/",
+			tesuto.DumpOnFailure(),
+			tesuto.ExpectStatusCode(http.StatusCreated),
+			tesuto.ExpectHeader("X-Version", "2"),
+			tesuto.ExpectRawResponse([]byte("other text")),
+		))
+		if !strings.Contains(out, "[GET /] 3 expectations failed:") {
+			t.Error("failures not combined:", out)
+		}
+		for _, want := range []string{"1. unexpected response code", "2. unexpected response header (X-Version)", "3. "} {
+			if !strings.Contains(out, want) {
+				t.Errorf("missing %q in output: %s", want, out)
+			}
+		}
+		if strings.Count(out, "output:") != 1 || !strings.Contains(out, "body text") {
+			t.Error("output not logged once on failure:", out)
+		}
+		if strings.Count(out, "response dump:") != 1 || !strings.Contains(out, "X-Version: 1") {
+			t.Error("headers not dumped once on failure:", out)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		out := expectFailure(t, func(t *testing.T) {
+			suite.GET("/",
+				tesuto.FatalFailure(t),
+				tesuto.ExpectStatusCode(http.StatusCreated),
+				tesuto.ExpectHeader("X-Version", "2"),
+			)(t)
+			t.Log("not stopped")
+		})
+		if !strings.Contains(out, "[GET /] unexpected response code") {
+			t.Error("first failure not reported:", out)
+		}
+		if strings.Contains(out, "X-Version") || strings.Contains(out, "not stopped") {
+			t.Error("FatalFailure didn't stop at the first failure:", out)
+		}
+		if !strings.Contains(out, "output:") {
+			t.Error("output not logged on fatal failure:", out)
+		}
+	})
+
+	t.Run("passing", func(t *testing.T) {
+		ok, out := runTest(t, suite.GET("/", tesuto.DumpOnFailure(), tesuto.ExpectStatusCode(http.StatusOK)))
+		if !ok {
+			t.Error("test failed:", out)
+		}
+		if strings.Contains(out, "output:") || strings.Contains(out, "dump:") {
+			t.Error("output logged without failure:", out)
+		}
+	})
+}
+
+func TestVerbose(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "body text")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	// by default, output is only logged on failure
+	if _, out := runTest(t, suite.GET("/")); strings.Contains(out, "body text") {
+		t.Error("output logged without failure:", out)
+	}
+	if out := expectFailure(t, suite.GET("/", tesuto.ExpectStatusCode(http.StatusCreated))); !strings.Contains(out, "body text") {
+		t.Error("output not logged on failure:", out)
+	}
+
+	suite.Verbose(true)
+	if _, out := runTest(t, suite.GET("/")); !strings.Contains(out, "body text") {
+		t.Error("verbose output not logged:", out)
+	}
+	if out := expectFailure(t, suite.GET("/", tesuto.ExpectStatusCode(http.StatusCreated))); strings.Count(out, "body text") != 1 {
+		t.Error("verbose output not logged once on failure:", out)
+	}
+}
+
+func TestExpectHeaderValues(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("vary", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectHeaderValues("Vary", []string{"Accept-Encoding", "Origin"}),
+		tesuto.ExpectHeaderValues("Set-Cookie", nil),
+	))
+
+	t.Run("count", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectHeaderCount("Vary", 2),
+		tesuto.ExpectHeaderCount("date", 1),
+		tesuto.ExpectHeaderCount("Set-Cookie", 0),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectHeaderCount("Vary", 1)))
+	if !strings.Contains(out, `unexpected response header count (Vary): want 1, got 2: ["Origin" "Accept-Encoding"]`) {
+		t.Error("wrong header count not reported:", out)
+	}
+}
+
+func TestExpectHeaders(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("headers", suite.GET(
+		"/",
+		tesuto.ExpectHeaders(map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"cache-control":               "no-store",
+			"X-Absent":                    "",
+		}),
+	))
+
+	out := expectFailure(t, suite.GET(
+		"/",
+		tesuto.ExpectHeaders(map[string]string{
+			"Access-Control-Allow-Origin": "https://example.com",
+			"Cache-Control":               "no-cache",
+			"X-Absent":                    "",
+		}),
+	))
+	if !strings.Contains(out, "[GET /] 2 expectations failed:") ||
+		!strings.Contains(out, "1. unexpected response header (Access-Control-Allow-Origin): want https://example.com, got *") ||
+		!strings.Contains(out, "2. unexpected response header (Cache-Control): want no-cache, got no-store") {
+		t.Error("both wrong headers not reported together:", out)
+	}
+}
+
+func TestExpectHeadersPresent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "abc")
+		w.Header().Set("X-Trace", "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("present", suite.GET(
+		"/",
+		tesuto.ExpectHeadersPresent("X-Request-Id", "x-trace", "Date"),
+	))
+}
+
+func TestCORS(t *testing.T) {
+	cors := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if origin := r.Header.Get("Origin"); origin == "https://app.example.com" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if r.Method == http.MethodOptions {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	})
+	server := httptest.NewServer(cors(mux))
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("simple request", suite.Test(
+		"GET",
+		"/items",
+		tesuto.ExpectCORS("https://app.example.com"),
+	))
+
+	t.Run("preflight", suite.PreflightTest(
+		"/items",
+		"https://app.example.com",
+		"PUT",
+		tesuto.WithHeader("Access-Control-Request-Headers", "Content-Type"),
+		tesuto.ExpectStatusCode(http.StatusNoContent),
+		tesuto.ExpectHeader("Access-Control-Allow-Headers", "Content-Type"),
+	))
+
+	out := expectFailure(t, suite.GET("/items", tesuto.ExpectCORS("https://evil.example.com")))
+	if !strings.Contains(out, "unexpected response header (Access-Control-Allow-Origin): want https://evil.example.com, got \n") {
+		t.Error("disallowed origin not reported:", out)
+	}
+	out = expectFailure(t, suite.PreflightTest("/items", "https://app.example.com", "PATCH"))
+	if !strings.Contains(out, "unexpected response header (Access-Control-Allow-Methods): want PATCH allowed, got GET, PUT, DELETE") {
+		t.Error("disallowed method not reported:", out)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		fmt.Fprint(w, "secure")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("baseline", suite.Test(
+		"GET",
+		"/",
+		tesuto.ExpectSecurityHeaders(tesuto.SecurityHeaders{
+			ContentTypeOptions: "nosniff",
+			FrameOptions:       "DENY",
+			ReferrerPolicy:     "no-referrer",
+		}),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectSecurityHeaders(tesuto.SecurityHeaders{
+		ContentTypeOptions:      "nosniff",
+		StrictTransportSecurity: "max-age=63072000",
+	})))
+	if !strings.Contains(out, "unexpected response header (Strict-Transport-Security): want max-age=63072000, got \n") {
+		t.Error("missing header not reported:", out)
+	}
+}
+
+func TestGrabJarCookies(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret", Path: "/"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cookies []*http.Cookie
+	t.Run("login", suite.Test(
+		"POST",
+		"/login",
+		tesuto.WithCookieJar(jar),
+		tesuto.GrabJarCookies(&cookies),
+	))
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "s3cret" {
+		t.Error("unexpected cookies:", cookies)
+	}
+
+	// the suite's jar and fresh jars work too
+	suite.ResetJar()
+	cookies = nil
+	t.Run("suite jar", suite.POST("/login", tesuto.GrabJarCookies(&cookies)))
+	if len(cookies) != 1 {
+		t.Error("unexpected suite jar cookies:", cookies)
+	}
+	cookies = nil
+	t.Run("fresh jar", suite.POST("/login", tesuto.FreshJar(), tesuto.GrabJarCookies(&cookies)))
+	if len(cookies) != 1 {
+		t.Error("unexpected fresh jar cookies:", cookies)
+	}
+}
+
+func TestExpectJSONEquivalent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name":"greg","age":30,"roles":["admin","dev"],"meta":{"active":true}}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("reordered and reformatted", suite.Test(
+		"GET",
+		"/user",
+		tesuto.ExpectJSONEquivalent(`{
+			"meta": {"active": true},
+			"roles": ["admin", "dev"],
+			"age": 30.0,
+			"name": "greg"
+		}`),
+		tesuto.ColorDiff(),
+	))
+}
+
+func TestExpectJSONResponseFrom(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"%d","total":9.99,"customer":{"name":"greg","id":%d}}`, time.Now().UnixNano(), time.Now().Unix())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("ignoring generated fields", suite.Test(
+		"GET",
+		"/order",
+		tesuto.ExpectJSONResponseFrom(`{
+			"id": "placeholder",
+			"total": 9.99,
+			"customer": {"name": "greg"}
+		}`, tesuto.NotZero("id"), tesuto.IgnoreField("customer.id")),
+	))
+}
+
+func TestMethods(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Method)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("GET", suite.GET("/", tesuto.ExpectRawResponse([]byte("GET"))))
+	t.Run("POST", suite.POST("/", tesuto.ExpectRawResponse([]byte("POST"))))
+	t.Run("PUT", suite.PUT("/", tesuto.ExpectRawResponse([]byte("PUT"))))
+	t.Run("PATCH", suite.PATCH("/", tesuto.ExpectRawResponse([]byte("PATCH"))))
+	t.Run("DELETE", suite.DELETE("/", tesuto.ExpectRawResponse([]byte("DELETE"))))
+	t.Run("HEAD", suite.HEAD("/", tesuto.ExpectStatusCode(http.StatusOK), tesuto.ExpectRawResponse([]byte{})))
+	t.Run("OPTIONS", suite.OPTIONS("/", tesuto.ExpectRawResponse([]byte("OPTIONS"))))
+}
+
+func TestRun(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	suite.Run(t, "GET", "/ping", tesuto.ExpectRawResponse([]byte("pong")))
+	suite.Run(t, "GET", "/nope", tesuto.WithName("missing page"), tesuto.ExpectStatusCode(http.StatusNotFound))
+}
+
+func TestFormValue(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		fmt.Fprintf(w, "%s %q %q", r.PostForm.Get("q"), r.PostForm["tag"], r.PostForm.Get("page"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("merged values", suite.Test(
+		"POST",
+		"/search",
+		tesuto.WithFormInput(url.Values{"q": {"cats"}, "tag": {"cute"}}),
+		tesuto.WithFormValue("tag", "fluffy"),
+		tesuto.WithFormValue("page", "2"),
+		tesuto.ExpectRawResponse([]byte(`cats ["cute" "fluffy"] "2"`)),
+	))
+}
+
+func TestExpectBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("png signature", suite.Test(
+		"GET",
+		"/image.png",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectBody(func(t testing.TB, body []byte) {
+			if !bytes.HasPrefix(body, []byte("\x89PNG")) {
+				t.Errorf("not a PNG: %q", body)
+			}
+		}),
+	))
+}
+
+func TestExpectResponse(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Length", "5")
+		fmt.Fprint(w, "hello")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	checkLength := tesuto.ExpectResponse(func(t testing.TB, resp *http.Response, body []byte) {
+		if want := resp.Header.Get("X-Length"); fmt.Sprint(len(body)) != want {
+			t.Errorf("body is %d bytes, header says %s", len(body), want)
+		}
+	})
+	t.Run("consistent", suite.GET("/", checkLength))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectResponse(func(t testing.TB, resp *http.Response, body []byte) {
+		t.Errorf("unwanted %s", resp.Status)
+	})))
+	if !strings.Contains(out, "response check failed: unwanted 200 OK") {
+		t.Error("failure not reported:", out)
+	}
+}
+
+func TestExpectBodyRetry(t *testing.T) {
+	var mu sync.Mutex
+	var n int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/count", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n++
+		fmt.Fprint(w, n)
+		mu.Unlock()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	atLeast := func(want string) tesuto.TestOption {
+		return tesuto.ExpectBody(func(t testing.TB, body []byte) {
+			if string(body) < want {
+				t.Fatalf("count too low: %s", body)
+			}
+			t.Error("not reached after Fatal")
+		})
+	}
+
+	// only the failures of the last attempt count
+	t.Run("retried", suite.GET("/count",
+		tesuto.RetryUntil(3, time.Millisecond),
+		tesuto.ExpectBody(func(t testing.TB, body []byte) {
+			if string(body) != "2" {
+				t.Errorf("count is %s", body)
+			}
+		}),
+	))
+
+	out := expectFailure(t, suite.GET("/count", atLeast("9")))
+	if !strings.Contains(out, "count too low: 3") {
+		t.Error("failure not reported:", out)
+	}
+	if strings.Contains(out, "not reached") {
+		t.Error("Fatal didn't stop the check:", out)
+	}
+}
+
+func TestCaptureRequest(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tesuto-Capture") != "" {
+			t.Error("handler saw capture header")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	suite := tesuto.NewCapturing(mux)
+	defer suite.Close()
+
+	var captured tesuto.CapturedRequest
+	t.Run("captured", suite.Test(
+		"POST",
+		"/proxy?x=1",
+		tesuto.WithJSONInput(map[string]int{"n": 1}),
+		tesuto.WithHeader("X-Custom", "yes"),
+		tesuto.CaptureRequest(&captured),
+		tesuto.ExpectStatusCode(http.StatusAccepted),
+	))
+	if captured.Method != "POST" || captured.URL.Path != "/proxy" || captured.URL.Query().Get("x") != "1" {
+		t.Error("unexpected request:", captured.Method, captured.URL)
+	}
+	if captured.Header.Get("X-Custom") != "yes" || captured.Header.Get("Content-Type") != "application/json" {
+		t.Error("unexpected headers:", captured.Header)
+	}
+	if string(captured.Body) != `{"n":1}` {
+		t.Errorf("unexpected body: %s", captured.Body)
+	}
+
+	var recorded tesuto.CapturedRequest
+	t.Run("recorder", func(t *testing.T) {
+		tesuto.TestHandler(t, mux, "POST", "/proxy",
+			tesuto.WithRawBody("hi"),
+			tesuto.CaptureRequest(&recorded),
+		)
+	})
+	if string(recorded.Body) != "hi" {
+		t.Errorf("unexpected body: %s", recorded.Body)
+	}
+}
+
+func TestExpectLocationURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/auth?next=%2Fhome", http.StatusSeeOther)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("redirect", suite.Test(
+		"GET",
+		"/login",
+		tesuto.NoFollowRedirects(),
+		tesuto.ExpectStatusCode(http.StatusSeeOther),
+		tesuto.ExpectLocationURL(func(t testing.TB, u *url.URL) {
+			if u.Host != strings.TrimPrefix(server.URL, "http://") {
+				t.Error("Location not resolved against request URL:", u)
+			}
+			if u.Path != "/auth" || u.Query().Get("next") != "/home" {
+				t.Error("unexpected Location:", u)
+			}
+		}),
+	))
+}
+
+func TestExpectJSONError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": "not_found", "message": "no such thing"}, "detail": {"kind": "missing"}}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("default path", suite.GET(
+		"/",
+		tesuto.ExpectStatusCode(http.StatusNotFound),
+		tesuto.ExpectJSONError("not_found"),
+	))
+
+	custom := tesuto.New(server)
+	custom.ErrorCodePath("detail.kind")
+	t.Run("custom path", custom.GET(
+		"/",
+		tesuto.ExpectJSONError("missing"),
+	))
+
+	t.Run("default path is unaffected", suite.GET(
+		"/",
+		tesuto.ExpectJSONError("not_found"),
+	))
+
+	custom.ErrorCodePath("")
+	t.Run("reset", custom.GET(
+		"/",
+		tesuto.ExpectJSONError("not_found"),
+	))
+}
+
+func TestFailAfter(t *testing.T) {
+	canceled := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	})
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fast")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("fast", suite.GET(
+		"/fast",
+		tesuto.FailAfter(5*time.Second),
+		tesuto.ExpectRawResponse([]byte("fast")),
+	))
+
+	expectFailure(t, suite.GET("/hang", tesuto.FailAfter(50*time.Millisecond)))
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("request wasn't canceled")
+	}
+}
+
+func TestCassette(t *testing.T) {
+	var hits int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Hits", fmt.Sprint(hits))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s", r.URL.Query().Get("q"), body)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	path := t.TempDir() + "/cassette.json"
+
+	for _, q := range []string{"a", "b"} {
+		t.Run("record "+q, suite.POST(
+			"/echo?q="+q,
+			tesuto.WithRawBody("body"),
+			tesuto.RecordTo(path),
+			tesuto.ExpectStatusCode(http.StatusCreated),
+			tesuto.ExpectRawResponse([]byte(q+" body")),
+		))
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cassette tesuto.Cassette
+	if err := json.Unmarshal(raw, &cassette); err != nil {
+		t.Fatal(err)
+	}
+	if len(cassette.Interactions) != 2 {
+		t.Fatalf("want 2 recorded interactions, got %d:\n%s", len(cassette.Interactions), raw)
+	}
+
+	server.Close()
+	t.Run("replay", suite.POST(
+		"/echo?q=b",
+		tesuto.WithRawBody("body"),
+		tesuto.ReplayFrom(path),
+		tesuto.ExpectStatusCode(http.StatusCreated),
+		tesuto.ExpectHeader("X-Hits", "2"),
+		tesuto.ExpectRawResponse([]byte("b body")),
+	))
+	if hits != 2 {
+		t.Error("replay hit the server")
+	}
+}
+
+func TestTimeZones(t *testing.T) {
+	type event struct {
+		At time.Time
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"At": "2020-01-01T09:00:00+09:00"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	// times are compared as instants, whatever their zones
+	want := event{At: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t.Run("same instant", suite.GET(
+		"/",
+		tesuto.ExpectJSONResponse(want),
+	))
+	expectFailure(t, suite.GET("/", tesuto.ExpectJSONResponse(event{At: time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)})))
+	t.Run("approx", suite.GET(
+		"/",
+		tesuto.ExpectJSONResponse(want, tesuto.EquateApproxTime(time.Second)),
+	))
+}
+
+func TestGzipInput(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "not gzipped", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.ContentLength <= 0 {
+			http.Error(w, "missing content length", http.StatusLengthRequired)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.Copy(w, zr)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("echo", suite.POST(
+		"/",
+		tesuto.WithGzipInput(strings.NewReader(`{"hello": "world"}`)),
+		tesuto.WithHeader("Content-Type", "application/json"),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte(`{"hello": "world"}`)),
+	))
+}
+
+func TestExpectJSONCountWhere(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"users":[{"status":"active"},{"status":"banned"},{"status":"active"},{"status":"active"}]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	active := func(item json.RawMessage) bool {
+		var user struct{ Status string }
+		return json.Unmarshal(item, &user) == nil && user.Status == "active"
+	}
+	t.Run("active users", suite.GET(
+		"/users",
+		tesuto.ExpectJSONCountWhere("users", active, 3),
+	))
+
+	out := expectFailure(t, suite.GET("/users", tesuto.ExpectJSONCountWhere("users", active, 4)))
+	if !strings.Contains(out, "unexpected count of matching JSON array elements (users): want 4, got 3 of 4") {
+		t.Error("wrong count not reported:", out)
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, `{}`)
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "hi")
+	})
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	suite.RequireContentType("application/json")
+
+	t.Run("json", suite.GET("/json"))
+	t.Run("no content", suite.GET("/empty"))
+	t.Run("allowed", suite.GET("/text", tesuto.AllowContentType("text/plain")))
+	t.Run("allow any", suite.GET("/text", tesuto.AllowContentType()))
+	t.Run("override", suite.GET("/text", tesuto.ExpectContentType("text/plain")))
+
+	t.Run("wrong type", func(t *testing.T) {
+		out := expectFailure(t, suite.GET("/text"))
+		if !strings.Contains(out, "unexpected response media type (Content-Type): want application/json, got text/plain") {
+			t.Error("wrong media type not reported:", out)
+		}
+	})
+	t.Run("allowance is per test", func(t *testing.T) {
+		allowed := suite.GET("/text", tesuto.AllowContentType("text/plain"))
+		if ok, out := runTest(t, allowed); !ok {
+			t.Error("allowed type failed:", out)
+		}
+		out := expectFailure(t, suite.GET("/text"))
+		if !strings.Contains(out, "want application/json, got text/plain") {
+			t.Error("allowance leaked into the next test:", out)
+		}
+		out = expectFailure(t, suite.GET("/text", tesuto.AllowContentType("text/html")))
+		if !strings.Contains(out, "want one of [application/json text/html], got text/plain") {
+			t.Error("allowed types not reported:", out)
+		}
+	})
+}
+
+func TestExpectNotStatusCode(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad input", http.StatusBadRequest)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("not 500", suite.POST(
+		"/",
+		tesuto.WithRawBody("garbage"),
+		tesuto.ExpectNotStatusCode(http.StatusInternalServerError),
+		tesuto.ExpectNotStatusCode(http.StatusBadGateway),
+	))
+
+	out := expectFailure(t, suite.POST("/", tesuto.ExpectNotStatusCode(http.StatusBadRequest)))
+	if !strings.Contains(out, "unexpected response code: want anything but 400, got 400") {
+		t.Error("forbidden code not reported:", out)
+	}
+}
+
+func TestRawHeaders(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q %q %s", r.Header.Values("X-Dup"), r.Header.Get("X-Later"), r.URL.RawQuery)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("tampered", suite.GET(
+		"/",
+		tesuto.MutateRequest(func(r *http.Request) {
+			r.Header.Set("X-Later", r.Header.Get("X-Set"))
+			r.URL.RawQuery = "tampered=1"
+		}),
+		tesuto.WithRawHeader("x-dup", "a"),
+		tesuto.WithRawHeader("x-dup", "b"),
+		tesuto.WithHeader("X-Set", "set"),
+		tesuto.ExpectRawResponse([]byte(`["a" "b"] "set" tampered=1`)),
+	))
+}
+
+func TestExpectMaxBodySize(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0123456789")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("exact", suite.GET(
+		"/",
+		tesuto.ExpectMaxBodySize(10),
+		tesuto.ExpectRawResponse([]byte("0123456789")),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectMaxBodySize(9)))
+	if !strings.Contains(out, "response body too large: want at most 9 bytes, got more") {
+		t.Error("oversized body not reported:", out)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/endless", func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 4096))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	suite.MaxResponseSize(1024)
+
+	expectFailure(t, suite.GET("/endless"))
+
+	// repeated requests and Load are limited too
+	out := expectFailure(t, suite.GET("/endless", tesuto.Repeat(2)))
+	if !strings.Contains(out, "request 1 of 2: response body exceeds the limit of 1024 bytes") {
+		t.Error("repeated request not limited:", out)
+	}
+	result := suite.Load(t, 2, 4, "GET", "/endless", tesuto.AllowLoadErrors())
+	if result.Errors != 4 {
+		t.Error("Load didn't limit responses:", result)
+	}
+
+	suite.MaxResponseSize(0)
+	t.Run("unlimited", suite.GET("/big", tesuto.ExpectRawResponse(bytes.Repeat([]byte("x"), 4096))))
+}
+
+func TestExpectTextEquals(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "\n  <p>\n    Hello,   world\n  </p>\n\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("collapsed", suite.GET(
+		"/",
+		tesuto.ExpectTextEquals("<p> Hello, world </p>", tesuto.TrimSpace(), tesuto.CollapseWhitespace()),
+	))
+	t.Run("trimmed", suite.GET(
+		"/",
+		tesuto.ExpectTextEquals("<p>\n    Hello,   world\n  </p>\n", tesuto.TrimSpace()),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectTextEquals("<p>\n    Goodbye,   world\n  </p>", tesuto.TrimSpace())))
+	if diff := collapseSpace(out); !strings.Contains(diff, `"<p>", - " Goodbye, world", + " Hello, world", " </p>",`) {
+		t.Error("line diff not reported:", out)
+	}
+}
+
+func TestWithAccept(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch accept := strings.Join(r.Header.Values("Accept"), ", "); accept {
+		case "application/json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{}`)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, accept)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("json", suite.GET(
+		"/",
+		tesuto.WithAcceptJSON(),
+		tesuto.ExpectContentType("application/json"),
+	))
+	t.Run("several", suite.GET(
+		"/",
+		tesuto.WithAccept("text/html"),
+		tesuto.WithHeader("X-Other", "1"),
+		tesuto.WithAccept("text/plain;q=0.5"),
+		tesuto.ExpectContentType("text/plain"),
+		tesuto.ExpectRawResponse([]byte("text/html, text/plain;q=0.5")),
+	))
+}
+
+func TestETag(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/doc", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "doc.txt", time.Time{}, strings.NewReader("document"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var etag string
+	t.Run("fetch", suite.GET(
+		"/doc",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.GrabETag(&etag),
+	))
+	if etag != `"v1"` {
+		t.Fatal("unexpected ETag:", etag)
+	}
+	t.Run("cached", suite.GET(
+		"/doc",
+		tesuto.WithIfNoneMatch(etag),
+		tesuto.ExpectNotModified(),
+	))
+	t.Run("changed", suite.GET(
+		"/doc",
+		tesuto.WithIfNoneMatch(`"v0"`),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("document")),
+	))
+}
+
+func TestRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader(content))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("range", suite.GET(
+		"/download",
+		tesuto.WithRange(10, 19),
+		tesuto.ExpectPartialContent(10, 19, 1000),
+		tesuto.ExpectRawResponse([]byte("0123456789")),
+	))
+	t.Run("open-ended", suite.GET(
+		"/download",
+		tesuto.WithRange(500, -1),
+		tesuto.ExpectPartialContent(500, 999, 1000),
+	))
+}
+
+func TestExpectJSONResponseUnordered(t *testing.T) {
+	type user struct {
+		ID   int
+		Tags []string
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"ID": 2, "Tags": ["b", "a"]}, {"ID": 1}, {"ID": 3}]`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("structs", suite.GET(
+		"/users",
+		tesuto.ExpectJSONResponseUnordered([]user{
+			{ID: 1},
+			{ID: 2, Tags: []string{"b", "a"}},
+			{ID: 3},
+		}, func(v interface{}) string {
+			return fmt.Sprint(v.(user).ID)
+		}),
+	))
+
+	t.Run("maps", suite.GET(
+		"/users",
+		tesuto.ExpectJSONResponseUnordered([]interface{}{
+			map[string]interface{}{"ID": 3.0},
+			map[string]interface{}{"ID": 1.0},
+			map[string]interface{}{"ID": 2.0, "Tags": []interface{}{"b", "a"}},
+		}, func(v interface{}) string {
+			return fmt.Sprint(v.(map[string]interface{})["ID"])
+		}),
+	))
+}
+
+func TestNewURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.NewURL(server.URL + "/")
+	defer suite.Close()
+
+	t.Run("remote", suite.GET(
+		"/health",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("ok")),
+	))
+}
+
+func TestExpectJSONResponseInto(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ID": 42, "Name": "greg"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var got user
+	t.Run("into", suite.GET(
+		"/user",
+		tesuto.ExpectJSONResponseInto(&got, user{ID: 1, Name: "greg"}, tesuto.NotZero("ID")),
+	))
+	if got.ID != 42 {
+		t.Error("response not decoded into out:", got)
+	}
+}
+
+func TestRawRequest(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Method)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var raw []byte
+	t.Run("malformed", suite.GET(
+		"/",
+		tesuto.RawRequest([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nBad Header\r\n\r\n")),
+		tesuto.ExpectStatusCode(http.StatusBadRequest),
+		tesuto.GrabRawResponse(&raw),
+	))
+	if !bytes.HasPrefix(raw, []byte("HTTP/1.1 400 ")) {
+		t.Errorf("unexpected raw response: %q", raw)
+	}
+
+	t.Run("odd method", suite.GET(
+		"/",
+		tesuto.RawRequest([]byte("BREW / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("BREW")),
+	))
+
+	secure := tesuto.NewHTTP2(mux)
+	defer secure.Close()
+	t.Run("tls", secure.GET(
+		"/",
+		tesuto.RawRequest([]byte("GET / HTTP/1.0\r\n\r\n")),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("GET")),
+	))
+}
+
+func TestExpectJSONFieldType(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "a1", "n": -1.5e3, "ok": false, "tags": [], "meta": {}, "gone": null}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("types", suite.GET(
+		"/",
+		tesuto.ExpectJSONFieldType("", "object"),
+		tesuto.ExpectJSONFieldType("id", "string"),
+		tesuto.ExpectJSONFieldType("n", "number"),
+		tesuto.ExpectJSONFieldType("ok", "bool"),
+		tesuto.ExpectJSONFieldType("tags", "array"),
+		tesuto.ExpectJSONFieldType("meta", "object"),
+		tesuto.ExpectJSONFieldType("gone", "null"),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectJSONFieldType("id", "number")))
+	if !strings.Contains(out, "unexpected JSON type (id): want number, got string") {
+		t.Error("actual type not reported:", out)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Close)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var resp *http.Response
+	t.Run("close", suite.GET(
+		"/",
+		tesuto.WithConnClose(),
+		tesuto.ExpectRawResponse([]byte("true")),
+		tesuto.GrabResponse(&resp),
+	))
+	if resp == nil || !resp.Close {
+		t.Error("server didn't close the connection")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		orders  int
+		results = make(map[string]string)
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.Header.Get("Idempotency-Key")
+		result, ok := results[key]
+		if !ok || key == "" {
+			orders++
+			result = fmt.Sprintf(`{"order": %d}`, orders)
+			results[key] = result
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, result)
+	})
+	mux.HandleFunc("/key", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q %q", r.Header.Get("Idempotency-Key"), r.Header.Get("X-Request-Key"))
+	})
+	mux.HandleFunc("/endless", func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("deduplicated", suite.POST(
+		"/orders",
+		tesuto.WithJSONInput(map[string]int{"item": 1}),
+		tesuto.WithIdempotencyKey("abc"),
+		tesuto.ExpectIdempotent(),
+		tesuto.ExpectStatusCode(http.StatusCreated),
+		tesuto.ExpectRawResponse([]byte(`{"order": 1}`)),
+	))
+	if orders != 1 {
+		t.Error("want 1 order, got", orders)
+	}
+
+	// both responses are cut off at the size limit and compared
+	suite.MaxResponseSize(1024)
+	out := expectFailure(t, suite.GET("/endless", tesuto.ExpectIdempotent()))
+	if !strings.Contains(out, "request 1 of 2: response body exceeds the limit") {
+		t.Error("first response not limited:", out)
+	}
+	if strings.Contains(out, "changed when repeated") {
+		t.Error("limited responses compared unequal:", out)
+	}
+
+	custom := tesuto.New(server)
+	custom.IdempotencyHeader("X-Request-Key")
+	t.Run("custom header", custom.GET(
+		"/key",
+		tesuto.WithIdempotencyKey("def"),
+		tesuto.ExpectRawResponse([]byte(`"" "def"`)),
+	))
+	t.Run("default header", suite.GET(
+		"/key",
+		tesuto.WithIdempotencyKey("ghi"),
+		tesuto.ExpectRawResponse([]byte(`"ghi" ""`)),
+	))
+}
+
+func TestExpectJSONFile(t *testing.T) {
+	type user struct {
+		ID      int       `json:"id"`
+		Name    string    `json:"name"`
+		Created time.Time `json:"created"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": 1, "name": "greg", "created": %q}`, time.Now().Format(time.RFC3339))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("struct", suite.GET(
+		"/user",
+		tesuto.ExpectJSONFile("testdata/user.json", user{}, tesuto.IgnoreField("Created")),
+	))
+	t.Run("untyped", suite.GET(
+		"/user",
+		tesuto.ExpectJSONFile("testdata/user.json", nil, tesuto.IgnoreField("created")),
+	))
+}
+
+func TestLoad(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		n := hits
+		mu.Unlock()
+		if n%4 == 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("X-Load"))
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	result := suite.Load(t, 4, 20, "GET", "/items/{id}",
+		tesuto.WithPathParams(map[string]string{"id": "1"}),
+		tesuto.WithHeader("X-Load", "yes"),
+	)
+	if result.Requests != 20 || result.Errors != 0 || hits != 20 {
+		t.Errorf("unexpected result: %+v (hits %d)", result, hits)
+	}
+	if result.Codes[http.StatusOK] != 15 || result.Codes[http.StatusTooManyRequests] != 5 {
+		t.Error("unexpected status codes:", result.Codes)
+	}
+	if result.Min <= 0 || result.Min > result.Avg || result.Avg > result.Max {
+		t.Errorf("unexpected latencies: %+v", result)
+	}
+
+	result = suite.Load(t, 2, 4, "GET", "/hang", tesuto.FailAfter(50*time.Millisecond), tesuto.AllowLoadErrors())
+	if result.Errors != 4 {
+		t.Error("FailAfter ignored, want 4 errors, got", result.Errors)
+	}
+	out := expectFailure(t, func(t *testing.T) {
+		suite.Load(t, 2, 4, "GET", "/items/1", tesuto.RawRequest([]byte("GET /items/1 HTTP/1.1\r\nHost: x\r\n\r\n")))
+	})
+	if !strings.Contains(out, "Load can't send a RawRequest") {
+		t.Error("RawRequest not rejected:", out)
+	}
+
+	server.Close()
+	result = suite.Load(t, 2, 3, "GET", "/items/1", tesuto.AllowLoadErrors())
+	if result.Errors != 3 {
+		t.Error("want 3 errors, got", result.Errors)
+	}
+}
+
+func TestExpectJSONSortedBy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"items": [
+			{"name": "a", "meta": {"score": 9}},
+			{"name": "b", "meta": {"score": 9}},
+			{"name": "c", "meta": {"score": 2.5}}
+		]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("sorted", suite.GET(
+		"/",
+		tesuto.ExpectJSONSortedBy("items", "name", true),
+		tesuto.ExpectJSONSortedBy("items", "meta.score", false),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectJSONSortedBy("items", "meta.score", true)))
+	if !strings.Contains(out, `JSON array (items) not in ascending order by "meta.score": element 1 (9) is before element 2 (2.5)`) {
+		t.Error("out-of-order elements not reported:", out)
+	}
+	out = expectFailure(t, suite.GET("/", tesuto.ExpectJSONSortedBy("items", "name", false)))
+	if !strings.Contains(out, `JSON array (items) not in descending order by "name": element 0 (a) is before element 1 (b)`) {
+		t.Error("out-of-order elements not reported:", out)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	var buf bytes.Buffer
+	suite.Trace(&buf)
+
+	t.Run("first", suite.GET("/a?x=1"))
+	t.Run("second", suite.POST("/b"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "GET /a?x=1 418 ") || !strings.HasPrefix(lines[1], "POST /b 418 ") {
+		t.Errorf("unexpected trace:\n%s", buf.String())
+	}
+
+	// including repeated requests and Load
+	buf.Reset()
+	t.Run("repeated", suite.GET("/r", tesuto.Repeat(3)))
+	suite.Load(t, 2, 4, "GET", "/load")
+	if got := strings.Count(buf.String(), "GET /r 418 "); got != 3 {
+		t.Errorf("want 3 repeated requests traced, got %d:\n%s", got, buf.String())
+	}
+	if got := strings.Count(buf.String(), "GET /load 418 "); got != 4 {
+		t.Errorf("want 4 Load requests traced, got %d:\n%s", got, buf.String())
+	}
+
+	suite.Trace(nil)
+	t.Run("untraced", suite.GET("/c"))
+	if strings.Contains(buf.String(), "/c") {
+		t.Error("traced after Trace(nil)")
+	}
+}
+
+func TestRefererUserAgent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q %q", r.Header.Values("Referer"), r.Header.Values("User-Agent"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("set", suite.GET(
+		"/",
+		tesuto.WithReferer("https://example.com/form"),
+		tesuto.WithUserAgent("iPhone"),
+		tesuto.ExpectRawResponse([]byte(`["https://example.com/form"] ["iPhone"]`)),
+	))
+	t.Run("overridden", suite.GET(
+		"/",
+		tesuto.WithReferer("https://example.com/form"),
+		tesuto.WithUserAgent("iPhone"),
+		tesuto.WithHeader("Referer", "https://evil.example"),
+		tesuto.WithHeader("User-Agent", "Android"),
+		tesuto.ExpectRawResponse([]byte(`["https://evil.example"] ["Android"]`)),
+	))
+	t.Run("replaced by WithHeader", suite.GET(
+		"/",
+		tesuto.WithHeader("User-Agent", "iPhone"),
+		tesuto.WithHeader("User-Agent", "Android"),
+		tesuto.ExpectRawResponse([]byte(`[] ["Android"]`)),
+	))
+}
+
+func TestExpectJSON(t *testing.T) {
+	type created struct {
+		ID int `json:"id"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/things", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 7}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("created", suite.POST(
+		"/things",
+		tesuto.ExpectJSON(http.StatusCreated, created{ID: 7}),
+	))
+}
+
+func TestGrabStats(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "12345")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var stats tesuto.Stats
+	t.Run("stats", suite.GET("/", tesuto.GrabStats(&stats)))
+	if stats.StatusCode != http.StatusAccepted || stats.BodySize != 5 || stats.Duration <= 0 || stats.Proto != "HTTP/1.1" {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestExpectValidUTF8(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "日本語"}`)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		// truncated in the middle of a multibyte character
+		w.Write([]byte("日本語")[:4])
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("valid", suite.GET("/", tesuto.ExpectValidUTF8()))
+
+	expectFailure(t, suite.GET("/broken", tesuto.ExpectValidUTF8()))
+}
+
+type unavailableTransport struct{}
+
+func (unavailableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": {"1"}},
+		Body:       ioutil.NopCloser(strings.NewReader("down")),
+		Request:    req,
+	}, nil
+}
+
+func TestWithTransport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("injected", suite.GET(
+		"/",
+		tesuto.WithTransport(unavailableTransport{}),
+		tesuto.ExpectStatusCode(http.StatusServiceUnavailable),
+		tesuto.ExpectHeader("Retry-After", "1"),
+		tesuto.ExpectRawResponse([]byte("down")),
+	))
+	t.Run("unaffected", suite.GET(
+		"/",
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectRawResponse([]byte("up")),
+	))
+}
+
+func TestWithJSONString(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "want JSON", http.StatusUnsupportedMediaType)
+			return
+		}
+		var v interface{}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, "bad JSON", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("valid", suite.POST(
+		"/",
+		tesuto.WithJSONString(`{"a": 1}`),
+		tesuto.ExpectStatusCode(http.StatusNoContent),
+	))
+	t.Run("malformed", suite.POST(
+		"/",
+		tesuto.WithJSONString(`{"a": `),
+		tesuto.Repeat(2, http.StatusBadRequest),
+	))
+}
+
+func TestExpectJSONNull(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "greg", "nickname": null, "profile": {"bio": null}}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("null vs absent", suite.GET(
+		"/",
+		tesuto.ExpectJSONNull("nickname"),
+		tesuto.ExpectJSONNull("profile.bio"),
+		tesuto.ExpectJSONFieldAbsent("email"),
+		tesuto.ExpectJSONFieldAbsent("profile.avatar.url"),
+	))
+
+	for _, test := range []struct {
+		opt  tesuto.TestOption
+		want string
+	}{
+		{tesuto.ExpectJSONNull("email"), "unexpected JSON value (email): want null, got absent"},
+		{tesuto.ExpectJSONNull("name"), `unexpected JSON value (name): want null, got "greg"`},
+		{tesuto.ExpectJSONFieldAbsent("profile.bio"), "unexpected JSON value (profile.bio): want absent, got null"},
+	} {
+		if out := expectFailure(t, suite.GET("/", test.opt)); !strings.Contains(out, test.want) {
+			t.Errorf("want failure %q, got: %s", test.want, out)
+		}
+	}
+}
+
+func TestResetJar(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session"); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+	suite.ResetJar()
+
+	t.Run("login", suite.POST("/login"))
+	t.Run("logged in", suite.GET("/me", tesuto.ExpectStatusCode(http.StatusOK)))
+	t.Run("fresh jar", suite.GET("/me", tesuto.FreshJar(), tesuto.ExpectStatusCode(http.StatusUnauthorized)))
+
+	suite.ResetJar()
+	t.Run("after reset", suite.GET("/me", tesuto.ExpectStatusCode(http.StatusUnauthorized)))
+}
+
+func TestExpectEchoesInput(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("json", suite.POST(
+		"/echo",
+		tesuto.WithJSONInput(map[string]string{"hello": "world"}),
+		tesuto.ExpectEchoesInput(),
+	))
+	t.Run("form", suite.POST(
+		"/echo",
+		tesuto.WithFormValue("a", "1"),
+		tesuto.WithFormValue("b", "2"),
+		tesuto.ExpectEchoesInput(),
+	))
+	t.Run("empty", suite.GET("/echo", tesuto.ExpectEchoesInput()))
+	t.Run("func", suite.POST(
+		"/echo",
+		tesuto.WithInputFunc(func() io.Reader {
+			return strings.NewReader("streamed")
+		}),
+		tesuto.ExpectEchoesInput(),
+	))
+	expectFailure(t, suite.POST(
+		"/echo",
+		tesuto.WithInput(iotest.OneByteReader(strings.NewReader("unbuffered"))),
+		tesuto.ExpectEchoesInput(),
+	))
+}
+
+func TestEquateJSONNumbers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"answer": 42, "ratio": 0.5, "ids": [1, 2]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("ints and floats", suite.GET(
+		"/",
+		tesuto.ExpectJSONResponse(map[string]interface{}{
+			"answer": 42,
+			"ratio":  json.Number("0.5"),
+			"ids":    []interface{}{1, uint8(2)},
+		}, tesuto.EquateJSONNumbers()),
+	))
+
+	if !cmp.Equal(42, 42.0, tesuto.EquateJSONNumbers()) || cmp.Equal(42, 42.5, tesuto.EquateJSONNumbers()) {
+		t.Error("EquateJSONNumbers compared 42 incorrectly")
+	}
+
+	// numbers of the same type are left to other options
+	t.Run("with NotEmpty", suite.GET(
+		"/",
+		tesuto.ExpectJSONResponse(map[string]interface{}{
+			"answer": -1.0,
+			"ratio":  json.Number("0.5"),
+			"ids":    []interface{}{1, 2},
+		}, tesuto.EquateJSONNumbers(), tesuto.NotEmpty("answer")),
+	))
+	if !cmp.Equal(1.0, 1.05, tesuto.EquateJSONNumbers(), tesuto.EquateApproxFloat(0.1, 0)) {
+		t.Error("EquateJSONNumbers conflicted with EquateApproxFloat")
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	type stamped struct {
+		At time.Time `json:"at"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if t, ok := tesuto.ParseClock(r); ok {
+			now = t
+		}
+		json.NewEncoder(w).Encode(stamped{At: now})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	frozen := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	t.Run("frozen", suite.GET(
+		"/",
+		tesuto.WithClock(frozen),
+		tesuto.ExpectJSONResponse(stamped{At: frozen}),
+	))
+}
+
+func TestExpectCacheControl(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", `private,  Max-Age=60 ,no-cache="Set-Cookie"`)
+		w.Header().Add("Cache-Control", "must-revalidate")
+	})
+	mux.HandleFunc("/private", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", `private="Set-Cookie, Authorization", community="a \"quoted\", value"`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("directives", suite.GET(
+		"/",
+		tesuto.ExpectCacheControl(map[string]string{
+			"max-age":         "60",
+			"private":         "",
+			"no-cache":        "Set-Cookie",
+			"Must-Revalidate": "",
+		}),
+	))
+
+	t.Run("quoted commas", suite.GET(
+		"/private",
+		tesuto.ExpectCacheControl(map[string]string{
+			"private":   "Set-Cookie, Authorization",
+			"community": `a "quoted", value`,
+		}),
+	))
+
+	out := expectFailure(t, suite.GET("/", tesuto.ExpectCacheControl(map[string]string{
+		"max-age":  "120",
+		"no-store": "",
+	})))
+	if !strings.Contains(out, `unexpected response header (Cache-Control): max-age: want "120", got "60"; no-store missing; got "private,  Max-Age=60`) {
+		t.Error("directive mismatches not reported:", out)
+	}
+}
+
+func TestGrabJSONStrict(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ID": 1, "Name": "greg"}`)
+	})
+	mux.HandleFunc("/leaky", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ID": 1, "Name": "greg", "PasswordHash": "..."}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	var got user
+	t.Run("strict", suite.GET("/user", tesuto.GrabJSONStrict(&got)))
+	if got.Name != "greg" {
+		t.Error("unexpected user:", got)
+	}
+
+	expectFailure(t, suite.GET("/leaky", tesuto.GrabJSONStrict(&user{})))
+}
+
+func TestExpectWellFormed(t *testing.T) {
+	serve := func(contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprint(w, body)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json", serve("application/problem+json", `{"title": "ok"}`))
+	mux.HandleFunc("/xml", serve("application/xml", `<a><b>ok</b></a>`))
+	mux.HandleFunc("/html", serve("text/html; charset=utf-8", `<p>ok`))
+	mux.HandleFunc("/text", serve("text/plain", "日本語"))
+	mux.HandleFunc("/latin1", serve("text/plain; charset=iso-8859-1", "\xe9"))
+	mux.HandleFunc("/binary", serve("application/octet-stream", "\xff\xfe"))
+	mux.HandleFunc("/bad-json", serve("application/json", `{"title": `))
+	mux.HandleFunc("/bad-xml", serve("text/xml", `<a><b></a>`))
+	mux.HandleFunc("/bad-text", serve("text/plain", "\xff"))
+	mux.HandleFunc("/bad-html", serve("text/html", "<p>\xff"))
+	mux.HandleFunc("/deleted", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	for _, path := range []string{"/json", "/xml", "/html", "/text", "/latin1", "/binary"} {
+		t.Run(path, suite.GET(path, tesuto.ExpectWellFormed()))
+	}
+	// empty bodies are fine without content
+	t.Run("HEAD", suite.HEAD("/json", tesuto.ExpectWellFormed()))
+	t.Run("no content", suite.DELETE("/deleted", tesuto.ExpectWellFormed()))
+	for _, path := range []string{"/bad-json", "/bad-xml", "/bad-text", "/bad-html"} {
+		expectFailure(t, suite.GET(path, tesuto.ExpectWellFormed()))
+	}
+}
+
+func TestMethodBodies(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/items", http.StatusTemporaryRedirect)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		// HEAD responses have no body, so echo the request in headers
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Body", string(body))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	type bulkDelete struct {
+		IDs []int `json:"ids"`
+	}
+	input := bulkDelete{IDs: []int{1, 2, 3}}
+	want := `{"ids":[1,2,3]}`
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodOptions, "PURGE"} {
+		opts := []tesuto.TestOption{
+			tesuto.WithJSONInput(input),
+			tesuto.ExpectStatusCode(http.StatusOK),
+			tesuto.ExpectHeaders(map[string]string{"X-Method": method, "X-Body": want}),
+		}
+		t.Run(method, suite.Test(method, "/items", opts...))
+		t.Run(method+" redirect", suite.Test(method, "/redirect", opts...))
+		t.Run(method+" handler", func(t *testing.T) {
+			tesuto.TestHandler(t, http.HandlerFunc(handler), method, "/items", opts...)
+		})
+	}
+
+	t.Run("stream redirect", suite.DELETE("/redirect",
+		tesuto.WithInputFunc(func() io.Reader {
+			return iotest.OneByteReader(strings.NewReader(want))
+		}),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectHeader("X-Body", want),
+	))
+}
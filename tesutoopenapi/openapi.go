@@ -0,0 +1,129 @@
+// Package tesutoopenapi adds OpenAPI 3 support to tesuto.
+// It is a separate package so that tesuto itself doesn't depend on kin-openapi.
+package tesutoopenapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/guregu/tesuto"
+)
+
+// ExpectOpenAPI specifies that the response must conform to the OpenAPI 3 spec at specPath.
+// The request's method and path are matched against the spec's operations, then the response's
+// status code, headers, and body are validated against the matching operation.
+// The test fails if no operation matches or the spec is invalid. Schema violations are reported with the JSON pointer to the offending value.
+// The hosts of the spec's servers are ignored, so only their paths need to match the test server.
+// Specs are loaded once and shared by all tests.
+func ExpectOpenAPI(specPath string) tesuto.TestOption {
+	return tesuto.ExpectResponse(func(t testing.TB, resp *http.Response, body []byte) {
+		spec, err := loadOpenAPI(specPath)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req := resp.Request
+		route, params, err := spec.router.FindRoute(req)
+		if err != nil {
+			t.Errorf("no operation in OpenAPI spec %s for %s %s: %v", specPath, req.Method, req.URL.Path, err)
+			return
+		}
+		input := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    req,
+				PathParams: params,
+				Route:      route,
+			},
+			Status: resp.StatusCode,
+			Header: resp.Header,
+			Body:   ioutil.NopCloser(bytes.NewReader(body)),
+			Options: &openapi3filter.Options{
+				IncludeResponseStatus: true,
+				MultiError:            true,
+			},
+		}
+		if err := openapi3filter.ValidateResponse(context.Background(), input); err != nil {
+			t.Errorf("response doesn't match OpenAPI spec (%s %s):\n%s", route.Method, route.Path, openAPIErrors(err))
+		}
+	})
+}
+
+// openAPISpec is a loaded OpenAPI spec.
+type openAPISpec struct {
+	router routers.Router
+	err    error
+}
+
+var (
+	openAPISpecs   = make(map[string]*openAPISpec)
+	openAPISpecsMu sync.Mutex
+)
+
+// loadOpenAPI loads the spec at path, or returns the already loaded one.
+func loadOpenAPI(path string) (*openAPISpec, error) {
+	openAPISpecsMu.Lock()
+	defer openAPISpecsMu.Unlock()
+	if spec, ok := openAPISpecs[path]; ok {
+		return spec, spec.err
+	}
+	spec := new(openAPISpec)
+	openAPISpecs[path] = spec
+
+	doc, err := openapi3.NewLoader().LoadFromFile(path)
+	if err != nil {
+		spec.err = fmt.Errorf("couldn't load OpenAPI spec %s: %v", path, err)
+		return spec, spec.err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		spec.err = fmt.Errorf("invalid OpenAPI spec %s: %v", path, err)
+		return spec, spec.err
+	}
+	// tests run against a local server, so match only the paths of the servers
+	for _, server := range doc.Servers {
+		server.URL = serverPath(server.URL)
+	}
+	if spec.router, err = gorillamux.NewRouter(doc); err != nil {
+		spec.err = fmt.Errorf("couldn't route OpenAPI spec %s: %v", path, err)
+	}
+	return spec, spec.err
+}
+
+// serverPath returns the path of an OpenAPI server URL, like "/v1" for "https://{region}.example.com/v1".
+func serverPath(serverURL string) string {
+	if i := strings.Index(serverURL, "://"); i >= 0 {
+		serverURL = serverURL[i+len("://"):]
+		if j := strings.Index(serverURL, "/"); j >= 0 {
+			return serverURL[j:]
+		}
+		return "/"
+	}
+	return serverURL
+}
+
+// openAPIErrors formats validation errors one per line, with JSON pointers for schema errors.
+func openAPIErrors(err error) string {
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		lines := make([]string, 0, len(multi))
+		for _, err := range multi {
+			lines = append(lines, openAPIErrors(err))
+		}
+		return strings.Join(lines, "\n")
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return fmt.Sprintf("at /%s: %s", strings.Join(schemaErr.JSONPointer(), "/"), schemaErr.Reason)
+	}
+	return err.Error()
+}
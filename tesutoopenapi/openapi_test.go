@@ -0,0 +1,93 @@
+package tesutoopenapi_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/tesuto"
+	"github.com/guregu/tesuto/tesutoopenapi"
+)
+
+func TestExpectOpenAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": 1, "name": "Pochi"}`)
+	})
+	mux.HandleFunc("/v1/pets/2", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/v1/pets/3", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "three", "name": "Tama"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	t.Run("valid", suite.GET("/v1/pets/1", tesutoopenapi.ExpectOpenAPI("testdata/openapi.yaml")))
+	t.Run("not found", suite.GET("/v1/pets/2", tesutoopenapi.ExpectOpenAPI("testdata/openapi.yaml")))
+
+	t.Run("schema violation", func(t *testing.T) {
+		ok, out := runTest(t, suite.GET("/v1/pets/3", tesutoopenapi.ExpectOpenAPI("testdata/openapi.yaml")))
+		if ok {
+			t.Errorf("test didn't fail, output:\n%s", out)
+		}
+		if !strings.Contains(out, "response doesn't match OpenAPI spec (GET /pets/{id})") || !strings.Contains(out, "at /id: value must be an integer") {
+			t.Error("violation not reported with its JSON pointer:", out)
+		}
+	})
+}
+
+// runTest runs test as a separate top-level test with verbose output,
+// so that it can fail without failing t, and returns whether it passed along with its output.
+// t fails if test doesn't finish within 10 seconds.
+func runTest(t *testing.T, test func(*testing.T)) (ok bool, output string) {
+	t.Helper()
+	name := strings.SplitN(t.Name(), "/", 2)[0]
+	match := func(pattern, str string) (bool, error) {
+		return regexp.MatchString(pattern, str)
+	}
+
+	verbose := flag.Lookup("test.v").Value.String()
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("test.v", "true")
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+		flag.Set("test.v", verbose)
+	}()
+
+	var buf bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(copied)
+	}()
+	finished := make(chan bool)
+	go func() {
+		finished <- testing.RunTests(match, []testing.InternalTest{{Name: name, F: test}})
+	}()
+	select {
+	case ok = <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("test didn't finish")
+	}
+	w.Close()
+	<-copied
+	return ok, buf.String()
+}
@@ -0,0 +1,46 @@
+// Package tesutoproto adds protocol buffers support to tesuto.
+// It is a separate package so that tesuto itself doesn't depend on protobuf.
+package tesutoproto
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/guregu/tesuto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+// ContentType is the Content-Type used for protobuf request bodies.
+const ContentType = "application/x-protobuf"
+
+// WithProtoInput specifies the protobuf request body data for this test and sets the application/x-protobuf Content-Type.
+// The header can be overriden with WithHeader.
+func WithProtoInput(msg proto.Message) tesuto.TestOption {
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	return tesuto.Options(
+		tesuto.WithRawBytes(raw),
+		tesuto.WithHeader("Content-Type", ContentType),
+	)
+}
+
+// ExpectProtoResponse specifies a protobuf message that should match the response.
+// The response will be decoded into a new message of the same type as want and compared with protocmp.
+// Comparison options can be specified, such as protocmp.IgnoreFields.
+func ExpectProtoResponse(want proto.Message, compareOpt ...cmp.Option) tesuto.TestOption {
+	opts := append([]cmp.Option{protocmp.Transform()}, compareOpt...)
+	return tesuto.ExpectBody(func(t testing.TB, body []byte) {
+		t.Helper()
+		got := want.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(body, got); err != nil {
+			t.Errorf("couldn't decode protobuf output: %v", err)
+			return
+		}
+		if diff := cmp.Diff(want, got, opts...); diff != "" {
+			t.Errorf("output mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
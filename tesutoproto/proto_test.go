@@ -0,0 +1,113 @@
+package tesutoproto_test
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/tesuto"
+	"github.com/guregu/tesuto/tesutoproto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProto(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != tesutoproto.ContentType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, _ := ioutil.ReadAll(r.Body)
+		var msg wrapperspb.StringValue
+		if err := proto.Unmarshal(raw, &msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out, _ := proto.Marshal(wrapperspb.String(strings.ToUpper(msg.Value)))
+		w.Header().Set("Content-Type", tesutoproto.ContentType)
+		w.Write(out)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	suite := tesuto.New(server)
+
+	roundtrip := suite.Test(
+		"POST",
+		"/shout",
+		tesutoproto.WithProtoInput(wrapperspb.String("hello")),
+		tesuto.ExpectStatusCode(http.StatusOK),
+		tesuto.ExpectHeader("Content-Type", tesutoproto.ContentType),
+		tesutoproto.ExpectProtoResponse(wrapperspb.String("HELLO")),
+	)
+	t.Run("roundtrip", roundtrip)
+	// the input can be sent again
+	t.Run("again", roundtrip)
+	suite.Load(t, 2, 4, "POST", "/shout", tesutoproto.WithProtoInput(wrapperspb.String("hello")))
+
+	t.Run("mismatch", func(t *testing.T) {
+		ok, out := runTest(t, suite.POST(
+			"/shout",
+			tesutoproto.WithProtoInput(wrapperspb.String("hi")),
+			tesutoproto.ExpectProtoResponse(wrapperspb.String("HELLO")),
+		))
+		if ok {
+			t.Errorf("test didn't fail, output:\n%s", out)
+		}
+		if !strings.Contains(out, "output mismatch (-want +got):") || !strings.Contains(out, `"HELLO"`) || !strings.Contains(out, `"HI"`) {
+			t.Error("mismatch not reported:", out)
+		}
+	})
+}
+
+// runTest runs test as a separate top-level test with verbose output,
+// so that it can fail without failing t, and returns whether it passed along with its output.
+// t fails if test doesn't finish within 10 seconds.
+func runTest(t *testing.T, test func(*testing.T)) (ok bool, output string) {
+	t.Helper()
+	name := strings.SplitN(t.Name(), "/", 2)[0]
+	match := func(pattern, str string) (bool, error) {
+		return regexp.MatchString(pattern, str)
+	}
+
+	verbose := flag.Lookup("test.v").Value.String()
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("test.v", "true")
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+		flag.Set("test.v", verbose)
+	}()
+
+	var buf bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(copied)
+	}()
+	finished := make(chan bool)
+	go func() {
+		finished <- testing.RunTests(match, []testing.InternalTest{{Name: name, F: test}})
+	}()
+	select {
+	case ok = <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("test didn't finish")
+	}
+	w.Close()
+	<-copied
+	return ok, buf.String()
+}
@@ -0,0 +1,49 @@
+package tesuto
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Dial opens a WebSocket connection to the given path of the server.
+// Options that modify the request, such as WithHeader, WithCookie, and WithPathParams, are applied to the handshake request.
+// Expectations are not checked: examine the returned handshake response instead.
+// The caller is responsible for closing the connection.
+func (h HTTP) Dial(path string, opts ...TestOption) (*websocket.Conn, *http.Response, error) {
+	tc := h.newTestCase(http.MethodGet, path, opts)
+	if tc.optErr != nil {
+		return nil, nil, tc.optErr
+	}
+	if tc.pathParams != nil {
+		var err error
+		if path, err = expandPath(path, tc.pathParams); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// build a regular request so the options can modify it
+	req, err := http.NewRequest(http.MethodGet, h.url()+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc.mutate(req)
+	header := req.Header.Clone()
+	if req.Host != req.URL.Host {
+		header.Set("Host", req.Host)
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+	if tc.jar != nil {
+		dialer.Jar = tc.jar
+	}
+	if tr, ok := h.httpClient().Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = tr.TLSClientConfig
+	}
+	wsURL := "ws" + strings.TrimPrefix(req.URL.String(), "http")
+	return dialer.Dial(wsURL, header)
+}
@@ -0,0 +1,44 @@
+package tesuto
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+// WithYAMLInput specifies the YAML request body data for this test and sets the application/yaml Content-Type.
+// The header can be overriden with WithHeader.
+func WithYAMLInput(input interface{}) TestOption {
+	return func(tc *testCase) {
+		raw, err := yaml.Marshal(input)
+		if err != nil {
+			panic(err)
+		}
+		tc.setBody(raw)
+
+		tc.mutateReq = append(tc.mutateReq, func(r *http.Request) {
+			r.Header.Set("Content-Type", "application/yaml")
+		})
+	}
+}
+
+// ExpectYAMLResponse specifies a YAML object that should match the response.
+// The response will be decoded into the same type as the specified output and compared.
+// Comparison options can be specified.
+func ExpectYAMLResponse(output interface{}, compareOpt ...cmp.Option) TestOption {
+	return func(tc *testCase) {
+		tc.checkBody(func(res *result) error {
+			outptr := reflect.New(reflect.TypeOf(output))
+			if err := yaml.Unmarshal(res.body, outptr.Interface()); err != nil {
+				return fmt.Errorf("couldn't decode YAML output: %v", err)
+			}
+			if diff := cmp.Diff(output, outptr.Elem().Interface(), compareOpt...); diff != "" {
+				return fmt.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		})
+	}
+}